@@ -1,11 +1,19 @@
 package main
 
 import (
+	"config"
 	"flag"
 	"fmt"
 	"logger"
+	"net/url"
 	"os"
+	"os/signal"
 	"pget"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 var (
@@ -26,31 +34,98 @@ func (i *arrayHeader) String() string {
 
 func main() {
 
+	if len(os.Args) > 1 && os.Args[1] == "seed" {
+		seed(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		ctl(os.Args[2:])
+		return
+	}
+
 	var downloadHeader arrayHeader
 	var trackerHeader arrayHeader
+	var resolve arrayHeader
+	var peers arrayHeader
 	source := flag.String("s", "", "source url")
 	tracker := flag.String("t", "", "tracker url")
-	dst := flag.String("d", "", "the dst path")
+	dst := flag.String("d", "", "the dst path, - means write to stdout")
+	spill := flag.String("spill", "", "spill file for seeding when write to stdout")
+	streamWindow := flag.Int("stream-window", 8, "how many batches can be buffered when write to stdout")
 	concurrent := flag.Int("c", 3, "download concurrent")
+	adaptive := flag.Bool("adaptive", false, "adjust the download concurrent to the throughput, starting at -c")
+	minConcurrent := flag.Int("min-concurrent", 1, "min download concurrent of -adaptive")
+	maxConcurrent := flag.Int("max-concurrent", 32, "max download concurrent of -adaptive")
 	md5 := flag.String("m", "", "md5")
 	batchSize := flag.Int64("b", 2, "batch size, unit is MB")
+	pieceSize := flag.Int64("piece-size", 0, "fetch the batches in pieces of this size from several peers, unit is KB, 0 disables it")
 	debug := flag.Bool("debug", false, "debug mode")
+	logLevel := flag.String("log-level", "info", "log level, debug, info, warning or error")
+	logFormat := flag.String("log-format", "text", "log format, text or json")
+	logOutput := flag.String("log-output", "stdout", "log output, stdout, stderr or a file path")
 	upload := flag.Bool("upload", true, "as a upload peer")
 	uploadTime := flag.Int("upload-time", 60, "wait how many seconds to return when download finish")
 	downloadRate := flag.Int64("download-rate", 0, "download rate limit, unit is Mb")
 	uploadRate := flag.Int64("upload-rate", 0, "upload rate limit, unit is Mb")
+	originRate := flag.Int64("origin-rate", 0, "rate limit of the origin requests on top of the download rate, unit is Mb")
+	downloadSchedule := flag.String("download-schedule", "", "download rate by time of day, e.g. 09:00-18:00=10,22:00-06:00=0, unit is Mb, 0 is unlimited")
+	uploadSchedule := flag.String("upload-schedule", "", "upload rate by time of day, unit is Mb")
+	originSchedule := flag.String("origin-schedule", "", "origin rate by time of day, unit is Mb")
 	uploadConcurrent := flag.Int("upload-concurrent", 3, "upload concurrent")
+	uploadQueueTime := flag.Int("upload-queue-time", 0, "how many milliseconds an upload request waits for a free conn")
+	connectTimeout := flag.Int("connect-timeout", 10, "how many seconds to connect to a peer")
+	firstByteTimeout := flag.Int("first-byte-timeout", 10, "how many seconds to wait for the response header of a batch")
+	idleTimeout := flag.Int("idle-timeout", 10, "how many seconds a batch can make no progress")
+	batchTimeout := flag.Int("batch-timeout", 30, "min seconds to download a batch, more for large batches or low rates")
+	endgame := flag.Int("endgame", 2, "how many peers can fetch the same batch at the end of the download, less than 2 disables it")
+	maxIdleConns := flag.Int("max-idle-conns-per-host", 0, "idle conns kept per host, 0 sizes it to the concurrent")
+	keepAlive := flag.Int("keepalive", 30, "tcp keep-alive period in seconds, negative disables keep-alive")
+	http2 := flag.Bool("http2", true, "use http/2 with https origins and peers")
+	proxy := flag.String("proxy", "", "http or socks5 proxy url, direct for none, default is from HTTP_PROXY, HTTPS_PROXY and NO_PROXY")
+	originProxy := flag.String("origin-proxy", "", "proxy of the origin requests, default is -proxy")
+	trackerProxy := flag.String("tracker-proxy", "", "proxy of the tracker requests, default is -proxy")
+	peerProxy := flag.String("peer-proxy", "", "proxy of the peer requests, default is -proxy")
+	noProxy := flag.String("no-proxy", "", "comma separated hosts, domains and cidrs reached without proxy")
+	keepPartial := flag.Bool("keep-partial", false, "keep the partial file when download fail")
+	mode := flag.String("mode", "", "file mode of the dst, e.g. 0644")
+	owner := flag.String("owner", "", "owner of the dst, uid:gid")
+	report := flag.String("report", "", "write a json summary of the download to the file when it ends")
+	controlSocket := flag.String("control-socket", "", "unix socket to steer the download with pget ctl")
+	peersFile := flag.String("peers-file", "", "file of peer urls, one per line, used like -peer")
+	pexInterval := flag.Int("pex-interval", 10, "how many seconds to exchange peers with other peers, 0 disables it")
+	discovery := flag.Bool("discovery", false, "find the peers on the local network by udp multicast, with or without tracker")
+	discoveryGroup := flag.String("discovery-group", pget.DISCOVERY_GROUP, "multicast group of the discovery")
+	discoveryInterface := flag.String("discovery-interface", "", "network interface of the discovery, default is the system one")
+	locality := flag.String("locality", "", "topology labels of this peer, e.g. dc=us-east,zone=us-east-1a,rack=r12, the nearest peers are tried first")
+	denyCrossDC := flag.Bool("deny-cross-dc", false, "don't fetch from the peers of another dc, requires -locality with dc")
 	version := flag.Bool("v", false, "version")
+	configPath := flag.String(config.FLAG, "", "config file, default is "+config.DEFAULT_PATH+" if it exists")
 	flag.Var(&downloadHeader, "download-header", "headers for download http request")
 	flag.Var(&trackerHeader, "tracker-header", "headers for tracker http request")
+	flag.Var(&resolve, "resolve", "host:port:addr, connect to addr for host:port like curl")
+	flag.Var(&peers, "peer", "url of a peer which has the file, e.g. http://host:port, with or without tracker")
 	flag.Parse()
+	if err := config.Load(flag.CommandLine, *configPath, "pget", "PGET"); err != nil {
+		logger.GetLogger().Fatal(err)
+	}
 
 	if *version {
 		fmt.Printf("GitTag: %s \n", GitTag)
 		fmt.Printf("BuildTime: %s \n", BuildTime)
 		os.Exit(0)
 	}
-	logger.InitLogger(*debug)
+	stream := *dst == "-"
+	if stream && *logOutput == "stdout" {
+		// keep stdout for the file data
+		*logOutput = "stderr"
+	}
+	level := *logLevel
+	if *debug {
+		level = "debug"
+	}
+	if err := logger.Init(logger.Options{Level: level, Format: *logFormat, Output: *logOutput}); err != nil {
+		logger.GetLogger().Fatal(err)
+	}
 
 	g := logger.GetLogger()
 
@@ -62,17 +137,313 @@ func main() {
 		g.Fatal("source url is required")
 	}
 
-	p := pget.NewDownload(*source, *tracker, *dst, *concurrent, *md5, *batchSize*1024*1024, *upload, *uploadTime, *uploadConcurrent)
+	dstPath := *dst
+	if stream {
+		dstPath = *spill
+	}
+	p := pget.NewDownload(*source, *tracker, dstPath, *concurrent, *md5, *batchSize*1024*1024, *upload, *uploadTime, *uploadConcurrent)
+	if stream {
+		p.SetStreamOutput(os.Stdout, *streamWindow)
+	}
 
-	if *downloadRate > 0 {
-		p.SetDownloadRate(*downloadRate * 1024 * 1024 / 8)
+	limiters := map[string]*pget.Limiter{
+		"download": newLimiter(*downloadRate, *downloadSchedule),
+		"upload":   newLimiter(*uploadRate, *uploadSchedule),
+		"origin":   newLimiter(*originRate, *originSchedule),
+	}
+	p.SetDownloadLimiter(limiters["download"])
+	p.SetUploadLimiter(limiters["upload"])
+	p.SetOriginLimiter(limiters["origin"])
+	go reloadRates(*configPath, "pget", "PGET", limiters)
+	p.SetUploadQueueTime(time.Duration(*uploadQueueTime) * time.Millisecond)
+	if *adaptive {
+		p.SetAdaptiveConcurrency(*minConcurrent, *maxConcurrent)
+	}
+	p.SetTimeouts(time.Duration(*connectTimeout)*time.Second, time.Duration(*firstByteTimeout)*time.Second,
+		time.Duration(*idleTimeout)*time.Second, time.Duration(*batchTimeout)*time.Second)
+	if err := p.SetTransportOptions(pget.TransportOptions{
+		MaxIdleConnsPerHost: *maxIdleConns,
+		KeepAlive:           time.Duration(*keepAlive) * time.Second,
+		DisableHTTP2:        !*http2,
+		Proxy:               *proxy,
+		OriginProxy:         *originProxy,
+		TrackerProxy:        *trackerProxy,
+		PeerProxy:           *peerProxy,
+		NoProxy:             *noProxy,
+		Resolve:             resolve,
+	}); err != nil {
+		g.Fatal(err)
+	}
+	p.SetPexInterval(time.Duration(*pexInterval) * time.Second)
+	if *peersFile != "" {
+		filePeers, err := pget.ReadPeersFile(*peersFile)
+		if err != nil {
+			g.Fatal(err)
+		}
+		peers = append(peers, filePeers...)
+	}
+	if err := p.SetPeers(peers); err != nil {
+		g.Fatal(err)
 	}
-	if *uploadRate > 0 {
-		p.SetUploadRate(*uploadRate * 1024 * 1024 / 8)
+	if err := p.SetLocality(*locality, *denyCrossDC); err != nil {
+		g.Fatal(err)
 	}
-	fmt.Println(downloadHeader)
+	if *discovery {
+		if err := p.SetDiscovery(*discoveryGroup, *discoveryInterface); err != nil {
+			g.Fatal(err)
+		}
+	}
+	p.SetEndgame(*endgame)
+	p.SetPieceSize(*pieceSize * 1024)
+	p.SetKeepPartial(*keepPartial)
+	if *report != "" {
+		p.SetReport(*report)
+	}
+	if *mode != "" {
+		m, err := strconv.ParseUint(*mode, 8, 32)
+		if err != nil {
+			g.Fatalf("invalid mode:%s", *mode)
+		}
+		p.SetFileMode(os.FileMode(m))
+	}
+	if *owner != "" {
+		ids := strings.Split(*owner, ":")
+		if len(ids) != 2 {
+			g.Fatalf("invalid owner:%s", *owner)
+		}
+		uid, err := strconv.Atoi(ids[0])
+		if err != nil {
+			g.Fatalf("invalid owner:%s", *owner)
+		}
+		gid, err := strconv.Atoi(ids[1])
+		if err != nil {
+			g.Fatalf("invalid owner:%s", *owner)
+		}
+		p.SetFileOwner(uid, gid)
+	}
+	g.Debugf("download header:%v", downloadHeader)
 	p.SetDownloadRequestHeader(downloadHeader)
 	p.SetTrackerRequestHeader(trackerHeader)
+	if *controlSocket != "" {
+		c := pget.NewController()
+		c.Add(p)
+		if err := c.Listen(*controlSocket); err != nil {
+			g.Fatal(err)
+		}
+		defer c.Close()
+	}
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		reason := fmt.Sprintf("receive signal %v", <-sig)
+		// the file is complete once seeding, Start returns normally
+		if p.Status().State == pget.STATE_SEEDING {
+			g.Infof("stop seeding, %s", reason)
+			p.Stop()
+			return
+		}
+		p.Abort(reason)
+	}()
 	p.Start()
 
 }
+
+type seeder interface {
+	Seed() error
+	Stop()
+}
+
+// seed serves existing local files to the peers until it's stopped.
+func seed(args []string) {
+	var files arrayHeader
+	var downloadHeader arrayHeader
+	var trackerHeader arrayHeader
+	fs := flag.NewFlagSet("seed", flag.ExitOnError)
+	tracker := fs.String("t", "", "tracker url")
+	batchSize := fs.Int64("b", 2, "batch size, unit is MB")
+	debug := fs.Bool("debug", false, "debug mode")
+	logLevel := fs.String("log-level", "info", "log level, debug, info, warning or error")
+	logFormat := fs.String("log-format", "text", "log format, text or json")
+	logOutput := fs.String("log-output", "stdout", "log output, stdout, stderr or a file path")
+	heartbeat := fs.Int("heartbeat", 300, "how many seconds to announce the batches again")
+	pexInterval := fs.Int("pex-interval", 10, "how many seconds to exchange peers with other peers, 0 disables it")
+	discovery := fs.Bool("discovery", false, "announce the files on the local network by udp multicast, with or without tracker")
+	discoveryGroup := fs.String("discovery-group", pget.DISCOVERY_GROUP, "multicast group of the discovery")
+	discoveryInterface := fs.String("discovery-interface", "", "network interface of the discovery, default is the system one")
+	locality := fs.String("locality", "", "topology labels of this peer, e.g. dc=us-east,zone=us-east-1a,rack=r12")
+	uploadRate := fs.Int64("upload-rate", 0, "upload rate limit shared by the files, unit is Mb")
+	uploadSchedule := fs.String("upload-schedule", "", "upload rate by time of day, e.g. 09:00-18:00=10, unit is Mb, 0 is unlimited")
+	uploadConcurrent := fs.Int("upload-concurrent", 3, "upload concurrent of every file")
+	uploadQueueTime := fs.Int("upload-queue-time", 0, "how many milliseconds an upload request waits for a free conn")
+	fs.Var(&files, "f", "file to seed, path,source_url[,md5]")
+	fs.Var(&downloadHeader, "download-header", "headers for source http request")
+	fs.Var(&trackerHeader, "tracker-header", "headers for tracker http request")
+	controlSocket := fs.String("control-socket", "", "unix socket to steer the seeds with pget ctl")
+	configPath := fs.String(config.FLAG, "", "config file, default is "+config.DEFAULT_PATH+" if it exists")
+	fs.Parse(args)
+	if err := config.Load(fs, *configPath, "seed", "PGET_SEED"); err != nil {
+		logger.GetLogger().Fatal(err)
+	}
+
+	level := *logLevel
+	if *debug {
+		level = "debug"
+	}
+	if err := logger.Init(logger.Options{Level: level, Format: *logFormat, Output: *logOutput}); err != nil {
+		logger.GetLogger().Fatal(err)
+	}
+	g := logger.GetLogger()
+
+	if *tracker == "" && !*discovery {
+		g.Fatal("tracker url or discovery is required")
+	}
+	if len(files) == 0 {
+		g.Fatal("file is required")
+	}
+
+	uploadLimiter := newLimiter(*uploadRate, *uploadSchedule)
+	go reloadRates(*configPath, "seed", "PGET_SEED", map[string]*pget.Limiter{"upload": uploadLimiter})
+	c := pget.NewController()
+	var seeds []seeder
+	for _, file := range files {
+		params := strings.Split(file, ",")
+		if len(params) != 2 && len(params) != 3 {
+			g.Fatalf("invalid file:%s", file)
+		}
+		md5 := ""
+		if len(params) == 3 {
+			md5 = params[2]
+		}
+		p := pget.NewDownload(params[1], *tracker, params[0], 0, md5, *batchSize*1024*1024, true, 0, *uploadConcurrent)
+		p.SetUploadLimiter(uploadLimiter)
+		p.SetUploadQueueTime(time.Duration(*uploadQueueTime) * time.Millisecond)
+		p.SetHeartbeat(time.Duration(*heartbeat) * time.Second)
+		p.SetPexInterval(time.Duration(*pexInterval) * time.Second)
+		if err := p.SetLocality(*locality, false); err != nil {
+			g.Fatal(err)
+		}
+		if *discovery {
+			if err := p.SetDiscovery(*discoveryGroup, *discoveryInterface); err != nil {
+				g.Fatal(err)
+			}
+		}
+		p.SetDownloadRequestHeader(downloadHeader)
+		p.SetTrackerRequestHeader(trackerHeader)
+		seeds = append(seeds, p)
+		c.Add(p)
+	}
+	if *controlSocket != "" {
+		if err := c.Listen(*controlSocket); err != nil {
+			g.Fatal(err)
+		}
+		defer c.Close()
+	}
+
+	var wg sync.WaitGroup
+	for _, p := range seeds {
+		wg.Add(1)
+		go func(p seeder) {
+			defer wg.Done()
+			if err := p.Seed(); err != nil {
+				g.Fatal(err)
+			}
+		}(p)
+	}
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		g.Infof("receive signal %v, stop seeding", <-sig)
+		for _, p := range seeds {
+			p.Stop()
+		}
+	}()
+	wg.Wait()
+}
+
+// ctl sends a command to the control socket of a running pget, e.g.
+//
+//	pget ctl -s /run/pget.sock rate download=10 origin=5
+func ctl(args []string) {
+	fs := flag.NewFlagSet("ctl", flag.ExitOnError)
+	socket := fs.String("s", "", "control socket of the pget")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: pget ctl -s socket command [args]\n")
+		fmt.Fprintf(os.Stderr, "commands:\n")
+		fmt.Fprintf(os.Stderr, "  status\n  pause\n  resume\n")
+		fmt.Fprintf(os.Stderr, "  rate [download=Mb] [upload=Mb] [origin=Mb]\t0 is unlimited\n")
+		fmt.Fprintf(os.Stderr, "  concurrency n\n  seed-time seconds\n  abort [reason]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	g := logger.GetLogger()
+	if *socket == "" || fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	command, params := fs.Arg(0), url.Values{}
+	switch command {
+	case "status", "pause", "resume":
+	case "rate":
+		for _, arg := range fs.Args()[1:] {
+			kv := strings.SplitN(arg, "=", 2)
+			n, err := strconv.ParseInt(kv[len(kv)-1], 10, 64)
+			if len(kv) != 2 || err != nil {
+				g.Fatalf("invalid rate:%s, should be download=Mb, upload=Mb or origin=Mb", arg)
+			}
+			params.Set(kv[0], strconv.FormatInt(n*1024*1024/8, 10))
+		}
+	case "concurrency":
+		params.Set("n", fs.Arg(1))
+	case "seed-time":
+		params.Set("seconds", fs.Arg(1))
+	case "abort":
+		params.Set("reason", strings.Join(fs.Args()[1:], " "))
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+	body, err := pget.Control(*socket, command, params)
+	if err != nil {
+		g.Fatal(err)
+	}
+	os.Stdout.Write(body)
+}
+
+// newLimiter returns a limiter of rate Mb, with the rules of schedule.
+func newLimiter(rate int64, schedule string) *pget.Limiter {
+	l := pget.NewLimiter(rate * 1024 * 1024 / 8)
+	rules, err := pget.ParseSchedule(schedule, 1024*1024/8)
+	if err != nil {
+		logger.GetLogger().Fatal(err)
+	}
+	l.SetSchedule(rules)
+	return l
+}
+
+// reloadRates sets the rates and the schedules of the limiters from the
+// section of the config file on SIGHUP, the keys are the flag names, e.g.
+// download-rate and download-schedule for the download limiter.
+func reloadRates(path, section, envPrefix string, limiters map[string]*pget.Limiter) {
+	g := logger.GetLogger()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		path := config.Path(path, envPrefix)
+		if path == "" {
+			g.Warning("receive SIGHUP without config file")
+			continue
+		}
+		options, err := config.Read(path, section)
+		if err != nil {
+			g.Errorf("reload rates err:%v", err)
+			continue
+		}
+		for name, l := range limiters {
+			if err := l.Configure(options, name+"-rate", name+"-schedule", 1024*1024/8); err != nil {
+				g.Errorf("reload rates err:%v", err)
+				continue
+			}
+			logger.WithFields(logger.Fields{"limiter": name, "rate": l.Rate()}).Infof("reload rate")
+		}
+	}
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"config"
 	"flag"
 	"fmt"
 	"logger"
-	"net/http"
 	"os"
+	"os/signal"
+	"pget"
+	"syscall"
+	"time"
 )
 
 var (
@@ -13,17 +17,54 @@ var (
 	BuildTime = "2000-01-01T00:00:00+0800"
 )
 
+type arrayHeader []string
+
+func (i *arrayHeader) Set(value string) error {
+	*i = append(*i, value)
+	return nil
+}
+
+func (i *arrayHeader) String() string {
+	return fmt.Sprintf("%v", *i)
+}
+
 func main() {
+	var trackerHeader arrayHeader
 	addr := flag.String("a", "", "listen addr")
 	dir := flag.String("d", "", "static dir")
+	tracker := flag.String("t", "", "tracker url, register the files to it")
+	baseURL := flag.String("u", "", "the url of the static dir, e.g. http://origin.com/pkgs")
+	batchSize := flag.Int64("b", 2, "batch size, unit is MB")
+	heartbeat := flag.Int("heartbeat", 300, "how many seconds to register the files again")
+	locality := flag.String("locality", "", "topology labels the files are registered with, e.g. dc=us-east,zone=us-east-1a")
+	uploadRate := flag.Int64("upload-rate", 0, "upload rate limit, unit is Mb")
+	uploadSchedule := flag.String("upload-schedule", "", "upload rate by time of day, e.g. 09:00-18:00=10, unit is Mb, 0 is unlimited")
+	uploadConcurrent := flag.Int("upload-concurrent", 100, "upload concurrent")
+	uploadQueueTime := flag.Int("upload-queue-time", 0, "how many milliseconds an upload request waits for a free conn")
+	debug := flag.Bool("debug", false, "debug mode")
+	logLevel := flag.String("log-level", "info", "log level, debug, info, warning or error")
+	logFormat := flag.String("log-format", "text", "log format, text or json")
+	logOutput := flag.String("log-output", "stdout", "log output, stdout, stderr or a file path")
 	version := flag.Bool("v", false, "version")
+	configPath := flag.String(config.FLAG, "", "config file, default is "+config.DEFAULT_PATH+" if it exists")
+	flag.Var(&trackerHeader, "tracker-header", "headers for tracker http request")
 	flag.Parse()
+	if err := config.Load(flag.CommandLine, *configPath, "static_server", "STATIC_SERVER"); err != nil {
+		logger.GetLogger().Fatal(err)
+	}
 
 	if *version {
 		fmt.Printf("GitTag: %s \n", GitTag)
 		fmt.Printf("BuildTime: %s \n", BuildTime)
 		os.Exit(0)
 	}
+	level := *logLevel
+	if *debug {
+		level = "debug"
+	}
+	if err := logger.Init(logger.Options{Level: level, Format: *logFormat, Output: *logOutput}); err != nil {
+		logger.GetLogger().Fatal(err)
+	}
 	g := logger.GetLogger()
 	if *addr == "" {
 		g.Fatalf("addr is null")
@@ -31,5 +72,43 @@ func main() {
 	if *dir == "" {
 		g.Fatalf("static dir is null")
 	}
-	http.ListenAndServe(*addr, http.FileServer(http.Dir(*dir)))
+	if *tracker != "" && *baseURL == "" {
+		g.Fatalf("base url is required with tracker")
+	}
+	o := pget.NewOrigin(*dir, *baseURL, *tracker, *batchSize*1024*1024, *uploadConcurrent)
+	limiter := pget.NewLimiter(*uploadRate * 1024 * 1024 / 8)
+	rules, err := pget.ParseSchedule(*uploadSchedule, 1024*1024/8)
+	if err != nil {
+		g.Fatal(err)
+	}
+	limiter.SetSchedule(rules)
+	o.SetUploadLimiter(limiter)
+	go func() {
+		// adjust the upload rate from the config file
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGHUP)
+		for range sig {
+			path := config.Path(*configPath, "STATIC_SERVER")
+			if path == "" {
+				g.Warning("receive SIGHUP without config file")
+				continue
+			}
+			options, err := config.Read(path, "static_server")
+			if err == nil {
+				err = limiter.Configure(options, "upload-rate", "upload-schedule", 1024*1024/8)
+			}
+			if err != nil {
+				g.Errorf("reload rates err:%v", err)
+				continue
+			}
+			g.Infof("reload upload rate:%d", limiter.Rate())
+		}
+	}()
+	o.SetUploadQueueTime(time.Duration(*uploadQueueTime) * time.Millisecond)
+	o.SetHeartbeat(time.Duration(*heartbeat) * time.Second)
+	if err := o.SetLocality(*locality); err != nil {
+		g.Fatal(err)
+	}
+	o.SetTrackerRequestHeader(trackerHeader)
+	g.Fatal(o.ListenAndServe(*addr))
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"config"
 	"flag"
 	"fmt"
 	"logger"
@@ -18,8 +19,15 @@ func main() {
 	expire := flag.Int("t", 3600, "how many seconds the peer expire")
 	addr := flag.String("a", ":12345", "listen addr")
 	debug := flag.Bool("debug", false, "debug mode")
+	logLevel := flag.String("log-level", "info", "log level, debug, info, warning or error")
+	logFormat := flag.String("log-format", "text", "log format, text or json")
+	logOutput := flag.String("log-output", "stdout", "log output, stdout, stderr or a file path")
 	version := flag.Bool("v", false, "version")
+	configPath := flag.String(config.FLAG, "", "config file, default is "+config.DEFAULT_PATH+" if it exists")
 	flag.Parse()
+	if err := config.Load(flag.CommandLine, *configPath, "tracker", "TRACKER"); err != nil {
+		logger.GetLogger().Fatal(err)
+	}
 
 	if *version {
 		fmt.Printf("GitTag: %s \n", GitTag)
@@ -27,7 +35,13 @@ func main() {
 		os.Exit(0)
 	}
 	flag.Parse()
-	logger.InitLogger(*debug)
+	level := *logLevel
+	if *debug {
+		level = "debug"
+	}
+	if err := logger.Init(logger.Options{Level: level, Format: *logFormat, Output: *logOutput}); err != nil {
+		logger.GetLogger().Fatal(err)
+	}
 	t := tracker.NewTracker(*addr, *expire)
 	t.Server()
 
@@ -0,0 +1,128 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	DEFAULT_PATH = "/etc/pget.yaml"
+	// FLAG is the flag of the config file path, it isn't loaded from the
+	// config itself
+	FLAG = "config"
+)
+
+// Read returns the options of section in the yaml config file path, e.g.
+//
+//	pget:
+//	  t: http://tracker.com:12345
+//	  download-rate: 100
+//	  download-header:
+//	    - "Authorization:Basic cGdldDpwZ2V0"
+//
+// The keys are the flag names, a list sets a repeatable flag many times.
+func Read(path string, section string) (map[string][]string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// the scalars are kept as written, e.g. 0644 isn't turned into 420
+	var sections map[string]map[string]yaml.Node
+	if err := yaml.Unmarshal(content, &sections); err != nil {
+		return nil, errors.New(fmt.Sprintf("parse config %s err:%v", path, err))
+	}
+	options := make(map[string][]string)
+	for name, node := range sections[section] {
+		switch node.Kind {
+		case yaml.SequenceNode:
+			for _, item := range node.Content {
+				if item.Kind != yaml.ScalarNode {
+					return nil, errors.New(fmt.Sprintf("invalid option %s in section %s", name, section))
+				}
+				options[name] = append(options[name], scalar(item))
+			}
+		case yaml.ScalarNode:
+			options[name] = []string{scalar(&node)}
+		default:
+			return nil, errors.New(fmt.Sprintf("invalid option %s in section %s", name, section))
+		}
+	}
+	return options, nil
+}
+
+// scalar returns the text of a scalar node, empty for null.
+func scalar(node *yaml.Node) string {
+	if node.Tag == "!!null" {
+		return ""
+	}
+	return node.Value
+}
+
+// EnvName returns the environment variable of a flag, e.g. PGET_DOWNLOAD_RATE
+// for download-rate with prefix PGET.
+func EnvName(prefix string, name string) string {
+	return strings.ToUpper(prefix + "_" + strings.Replace(name, "-", "_", -1))
+}
+
+// Path returns the config file to use: path, else the path in the
+// environment, else DEFAULT_PATH if it exists. It's empty if there's none.
+func Path(path string, envPrefix string) string {
+	if path == "" {
+		path = os.Getenv(EnvName(envPrefix, FLAG))
+	}
+	if path == "" {
+		if _, err := os.Stat(DEFAULT_PATH); err == nil {
+			path = DEFAULT_PATH
+		}
+	}
+	return path
+}
+
+// Load sets the flags of fs which are not set on the command line, from the
+// environment first, then from the section of the config file. The config
+// file is resolved by Path.
+func Load(fs *flag.FlagSet, path string, section string, envPrefix string) error {
+	var options map[string][]string
+	path = Path(path, envPrefix)
+	if path != "" {
+		var err error
+		if options, err = Read(path, section); err != nil {
+			return err
+		}
+		for name := range options {
+			if fs.Lookup(name) == nil {
+				return errors.New(fmt.Sprintf("unknown option %s in section %s of %s", name, section, path))
+			}
+		}
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if set[f.Name] || f.Name == FLAG || err != nil {
+			return
+		}
+		if v, ok := os.LookupEnv(EnvName(envPrefix, f.Name)); ok {
+			if e := fs.Set(f.Name, v); e != nil {
+				err = errors.New(fmt.Sprintf("invalid env %s: %v", EnvName(envPrefix, f.Name), e))
+			}
+			return
+		}
+		for _, v := range options[f.Name] {
+			if e := fs.Set(f.Name, v); e != nil {
+				err = errors.New(fmt.Sprintf("invalid option %s in %s: %v", f.Name, path, e))
+				return
+			}
+		}
+	})
+	return err
+}
@@ -0,0 +1,114 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type arrayFlag []string
+
+func (a *arrayFlag) Set(value string) error {
+	*a = append(*a, value)
+	return nil
+}
+
+func (a *arrayFlag) String() string {
+	return fmt.Sprintf("%v", *a)
+}
+
+const testConfig = `
+pget:
+  t: http://tracker.com:12345
+  c: 5
+  debug: true
+  download-rate: 100
+  download-header:
+    - "Host:origin.com"
+    - "User-Agent:pget"
+tracker:
+  a: ":12345"
+`
+
+func writeConfig(content string) string {
+	path := "/tmp/pget-config.yaml"
+	ioutil.WriteFile(path, []byte(content), 0644)
+	return path
+}
+
+func TestRead(t *testing.T) {
+	path := writeConfig(testConfig)
+	defer os.Remove(path)
+	options, err := Read(path, "pget")
+	assert.NoError(t, err)
+	assert.Equal(t, options["t"], []string{"http://tracker.com:12345"})
+	assert.Equal(t, options["c"], []string{"5"})
+	assert.Equal(t, options["download-header"], []string{"Host:origin.com", "User-Agent:pget"})
+
+	options, err = Read(path, "static_server")
+	assert.NoError(t, err)
+	assert.Len(t, options, 0)
+}
+
+func TestReadScalar(t *testing.T) {
+	path := writeConfig("pget:\n  mode: 0644\n  upload-rate: 10000000\n  download-rate: 1e6\n  report:\n  peer: [0x10, ~]\n")
+	defer os.Remove(path)
+	options, err := Read(path, "pget")
+	assert.NoError(t, err)
+	// the scalars are kept as written
+	assert.Equal(t, []string{"0644"}, options["mode"])
+	assert.Equal(t, []string{"10000000"}, options["upload-rate"])
+	assert.Equal(t, []string{"1e6"}, options["download-rate"])
+	assert.Equal(t, []string{""}, options["report"])
+	assert.Equal(t, []string{"0x10", ""}, options["peer"])
+}
+
+func TestLoad(t *testing.T) {
+	path := writeConfig(testConfig)
+	defer os.Remove(path)
+	var header arrayFlag
+	fs := flag.NewFlagSet("pget", flag.ContinueOnError)
+	tracker := fs.String("t", "", "")
+	concurrent := fs.Int("c", 3, "")
+	debug := fs.Bool("debug", false, "")
+	rate := fs.Int64("download-rate", 0, "")
+	dst := fs.String("d", "", "")
+	fs.Var(&header, "download-header", "")
+	fs.Parse([]string{"-c", "10"})
+
+	os.Setenv("PGET_DOWNLOAD_RATE", "200")
+	defer os.Unsetenv("PGET_DOWNLOAD_RATE")
+	assert.NoError(t, Load(fs, path, "pget", "PGET"))
+	// flag > env > config > default
+	assert.Equal(t, *concurrent, 10)
+	assert.Equal(t, *rate, int64(200))
+	assert.Equal(t, *tracker, "http://tracker.com:12345")
+	assert.True(t, *debug)
+	assert.Equal(t, *dst, "")
+	assert.Equal(t, []string(header), []string{"Host:origin.com", "User-Agent:pget"})
+}
+
+func TestLoadUnknownOption(t *testing.T) {
+	path := writeConfig("tracker:\n  x: 1\n")
+	defer os.Remove(path)
+	fs := flag.NewFlagSet("tracker", flag.ContinueOnError)
+	fs.String("a", "", "")
+	assert.Error(t, Load(fs, path, "tracker", "TRACKER"))
+	assert.Error(t, Load(fs, "/tmp/pget-config-not-exist.yaml", "tracker", "TRACKER"))
+}
+
+func TestEnvName(t *testing.T) {
+	assert.Equal(t, EnvName("PGET", "upload-queue-time"), "PGET_UPLOAD_QUEUE_TIME")
+	assert.Equal(t, EnvName("STATIC_SERVER", "a"), "STATIC_SERVER_A")
+}
+
+func TestPath(t *testing.T) {
+	assert.Equal(t, Path("/tmp/a.yaml", "PGET"), "/tmp/a.yaml")
+	os.Setenv("PGET_CONFIG", "/tmp/b.yaml")
+	defer os.Unsetenv("PGET_CONFIG")
+	assert.Equal(t, Path("", "PGET"), "/tmp/b.yaml")
+}
@@ -0,0 +1,94 @@
+package logger
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Fields are the structured context of a message, e.g. source, batch, peer,
+// bytes and duration.
+type Fields map[string]interface{}
+
+// Entry logs messages with fields, in text they are appended to the message
+// as key=value, in json they are keys of the record.
+type Entry struct {
+	fields Fields
+}
+
+func WithFields(fields Fields) *Entry {
+	return &Entry{fields: fields}
+}
+
+// WithField returns a copy of the entry with key set to value.
+func (e *Entry) WithField(key string, value interface{}) *Entry {
+	fields := make(Fields, len(e.fields)+1)
+	for k, v := range e.fields {
+		fields[k] = v
+	}
+	fields[key] = value
+	return &Entry{fields: fields}
+}
+
+func (e *Entry) Debugf(format string, args ...interface{}) {
+	entryLogger.Debugf("%s", e.message(format, args))
+}
+
+func (e *Entry) Infof(format string, args ...interface{}) {
+	entryLogger.Infof("%s", e.message(format, args))
+}
+
+func (e *Entry) Warningf(format string, args ...interface{}) {
+	entryLogger.Warningf("%s", e.message(format, args))
+}
+
+func (e *Entry) Errorf(format string, args ...interface{}) {
+	entryLogger.Errorf("%s", e.message(format, args))
+}
+
+func (e *Entry) Fatalf(format string, args ...interface{}) {
+	entryLogger.Fatalf("%s", e.message(format, args))
+}
+
+func (e *Entry) message(format string, args []interface{}) *message {
+	return &message{text: fmt.Sprintf(format, args...), fields: e.fields}
+}
+
+// message is the single argument of an Entry record, the json backend
+// reads the fields from it.
+type message struct {
+	text   string
+	fields Fields
+}
+
+func (m *message) String() string {
+	keys := make([]string, 0, len(m.fields))
+	for k := range m.fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	s := m.text
+	for _, k := range keys {
+		v := fmt.Sprint(m.fields[k])
+		if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+			v = fmt.Sprintf("%q", v)
+		}
+		s += " " + k + "=" + v
+	}
+	return s
+}
+
+// value converts a field for json, durations are written in seconds and
+// errors as their message.
+func value(v interface{}) interface{} {
+	switch v := v.(type) {
+	case time.Duration:
+		return v.Seconds()
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
@@ -0,0 +1,60 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+var shortfile = logging.MustStringFormatter(`%{shortfile}`)
+
+// jsonBackend writes every record as a json object on its own line.
+type jsonBackend struct {
+	sync.Mutex
+	out io.Writer
+}
+
+func newJSONBackend(out io.Writer) *jsonBackend {
+	return &jsonBackend{out: out}
+}
+
+func (b *jsonBackend) Log(level logging.Level, calldepth int, rec *logging.Record) error {
+	var file bytes.Buffer
+	shortfile.Format(calldepth+1, rec, &file)
+	entry := make(map[string]interface{})
+	if m := recordMessage(rec); m != nil {
+		for k, v := range m.fields {
+			entry[k] = value(v)
+		}
+		entry["msg"] = m.text
+	} else {
+		entry["msg"] = rec.Message()
+	}
+	// fields can't override the keys of the record
+	entry["time"] = rec.Time.Format(time.RFC3339Nano)
+	entry["level"] = strings.ToLower(level.String())
+	entry["module"] = rec.Module
+	entry["file"] = file.String()
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	b.Lock()
+	defer b.Unlock()
+	_, err = b.out.Write(append(line, '\n'))
+	return err
+}
+
+// recordMessage returns the message of a record logged by an Entry.
+func recordMessage(rec *logging.Record) *message {
+	if len(rec.Args) != 1 {
+		return nil
+	}
+	m, _ := rec.Args[0].(*message)
+	return m
+}
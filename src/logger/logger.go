@@ -1,25 +1,104 @@
 package logger
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"strings"
 
 	"github.com/op/go-logging"
 )
 
+const (
+	FORMAT_TEXT = "text"
+	FORMAT_JSON = "json"
+)
+
 var logger = logging.MustGetLogger("pget")
 
+// entryLogger logs the messages of an Entry, one more frame is skipped to
+// report the caller of the Entry.
+var entryLogger = logging.MustGetLogger("pget")
+
+func init() {
+	entryLogger.ExtraCalldepth = 1
+}
+
+var output io.Writer = os.Stdout
+
+// SetOutput changes where InitLogger writes logs, the default is stdout.
+func SetOutput(w io.Writer) {
+	output = w
+}
+
+// Options of Init, the zero value logs INFO in text to the output set by
+// SetOutput.
+type Options struct {
+	// debug, info, notice, warning, error or critical
+	Level string
+	// text or json
+	Format string
+	// stdout, stderr or a file path
+	Output string
+}
+
 func InitLogger(debug bool) {
-	format := logging.MustStringFormatter(
-		`%{color}%{time:06-01-02 15:04:05.000} %{level:.4s} @%{shortfile}%{color:reset} %{message}`,
-	)
-	logging.SetFormatter(format)
-	backend := logging.NewLogBackend(os.Stdout, "", 0)
-	logging.SetBackend(backend)
+	level := "info"
 	if debug {
-		logging.SetLevel(logging.DEBUG, "pget")
-	} else {
-		logging.SetLevel(logging.INFO, "pget")
+		level = "debug"
+	}
+	Init(Options{Level: level})
+}
+
+// Init sets up the level, format and output of the logger.
+func Init(opts Options) error {
+	level := logging.INFO
+	if opts.Level != "" {
+		name := strings.ToUpper(opts.Level)
+		if name == "WARN" {
+			name = "WARNING"
+		}
+		l, err := logging.LogLevel(name)
+		if err != nil {
+			return errors.New(fmt.Sprintf("invalid log level:%s", opts.Level))
+		}
+		level = l
+	}
+
+	out := output
+	color := true
+	switch opts.Output {
+	case "", "stdout":
+		if opts.Output == "stdout" {
+			out = os.Stdout
+		}
+	case "stderr":
+		out = os.Stderr
+	default:
+		f, err := os.OpenFile(opts.Output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		out = f
+		color = false
+	}
+
+	switch opts.Format {
+	case "", FORMAT_TEXT:
+		layout := `%{time:06-01-02 15:04:05.000} %{level:.4s} @%{shortfile} %{message}`
+		if color {
+			layout = `%{color}%{time:06-01-02 15:04:05.000} %{level:.4s} @%{shortfile}%{color:reset} %{message}`
+		}
+		logging.SetFormatter(logging.MustStringFormatter(layout))
+		logging.SetBackend(logging.NewLogBackend(out, "", 0))
+	case FORMAT_JSON:
+		logging.SetBackend(newJSONBackend(out))
+	default:
+		return errors.New(fmt.Sprintf("invalid log format:%s", opts.Format))
 	}
+	logging.SetLevel(level, "pget")
+	return nil
 }
 
 func GetLogger() *logging.Logger {
@@ -0,0 +1,78 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInitInvalid(t *testing.T) {
+	assert.NotNil(t, Init(Options{Level: "verbose"}))
+	assert.NotNil(t, Init(Options{Format: "xml"}))
+}
+
+func TestJSON(t *testing.T) {
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	defer SetOutput(os.Stdout)
+	assert.Nil(t, Init(Options{Level: "debug", Format: FORMAT_JSON}))
+	defer InitLogger(false)
+
+	WithFields(Fields{"batch": 1, "peer": "http://a", "duration": 1500 * time.Millisecond, "err": errors.New("oops")}).Debugf("fetch batch:%d", 1)
+	GetLogger().Infof("plain %s", "message")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, 2, len(lines))
+	var entry map[string]interface{}
+	assert.Nil(t, json.Unmarshal([]byte(lines[0]), &entry))
+	assert.Equal(t, "fetch batch:1", entry["msg"])
+	assert.Equal(t, "debug", entry["level"])
+	assert.Equal(t, float64(1), entry["batch"])
+	assert.Equal(t, "http://a", entry["peer"])
+	assert.Equal(t, 1.5, entry["duration"])
+	assert.Equal(t, "oops", entry["err"])
+	assert.True(t, strings.HasPrefix(entry["file"].(string), "logger_test.go:"))
+
+	entry = nil
+	assert.Nil(t, json.Unmarshal([]byte(lines[1]), &entry))
+	assert.Equal(t, "plain message", entry["msg"])
+	assert.Equal(t, "info", entry["level"])
+	assert.True(t, strings.HasPrefix(entry["file"].(string), "logger_test.go:"))
+}
+
+func TestTextLevel(t *testing.T) {
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	defer SetOutput(os.Stdout)
+	assert.Nil(t, Init(Options{Level: "warn"}))
+	defer InitLogger(false)
+
+	GetLogger().Info("hidden")
+	WithFields(Fields{"peer": "http://a", "batch": 2, "msg": "a b"}).Warningf("fetch err")
+	out := buf.String()
+	assert.False(t, strings.Contains(out, "hidden"))
+	assert.True(t, strings.Contains(out, `fetch err batch=2 msg="a b" peer=http://a`))
+	assert.True(t, strings.Contains(out, "@logger_test.go:"))
+}
+
+func TestFileOutput(t *testing.T) {
+	file := "/tmp/pget_logger_test.log"
+	os.Remove(file)
+	defer os.Remove(file)
+	assert.Nil(t, Init(Options{Output: file}))
+	defer InitLogger(false)
+
+	GetLogger().Info("to file")
+	content, err := ioutil.ReadFile(file)
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(string(content), "to file"))
+	// no color codes in a file
+	assert.False(t, strings.Contains(string(content), "\033["))
+}
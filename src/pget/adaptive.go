@@ -0,0 +1,152 @@
+package pget
+
+import (
+	"logger"
+	"time"
+)
+
+const (
+	ADAPTIVE_INTERVAL = 2
+	// throughput below this ratio of the previous interval stops the growth
+	ADAPTIVE_TOLERANCE = 0.9
+)
+
+// concurrency is the state of the adaptive worker pool, guarded by the lock
+// of the download.
+type concurrency struct {
+	min    int
+	max    int
+	target int
+	active int
+	// measured in the current interval
+	bytes  int64
+	errors int
+	// bytes per second of the previous interval
+	throughput float64
+	interval   time.Duration
+}
+
+// SetAdaptiveConcurrency makes dispatch grow the workers one at a time
+// while the throughput increases and halve them when batches fail, between
+// min and max workers. The concurrent of NewDownload is the initial number.
+func (d *download) SetAdaptiveConcurrency(min int, max int) {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+	d.adaptive = &concurrency{min: min, max: max, interval: ADAPTIVE_INTERVAL * time.Second}
+}
+
+// adjust computes the next target from the interval just measured.
+func (c *concurrency) adjust(elapsed time.Duration) {
+	if c.bytes == 0 && c.errors == 0 {
+		// nothing measured, e.g. paused or a batch longer than the interval
+		return
+	}
+	throughput := float64(c.bytes) / elapsed.Seconds()
+	switch {
+	case c.errors > 0:
+		c.target /= 2
+	case throughput >= c.throughput*ADAPTIVE_TOLERANCE:
+		c.target += 1
+	}
+	c.clamp()
+	c.throughput = throughput
+	c.bytes = 0
+	c.errors = 0
+}
+
+func (c *concurrency) clamp() {
+	if c.target < c.min {
+		c.target = c.min
+	}
+	if c.target > c.max {
+		c.target = c.max
+	}
+}
+
+// startAdaptive starts the initial workers and the controller, which runs
+// until done is closed.
+func (d *download) startAdaptive(b chan int64, done chan bool) {
+	d.Lock()
+	d.adaptive.target = d.concurrent
+	d.adaptive.clamp()
+	d.Unlock()
+	d.spawnWorkers(b)
+	go d.control(b, done)
+}
+
+// recordThroughput counts the bytes and the failures for the controller.
+// Must be called with the lock held.
+func (d *download) recordThroughput(n int64, failed bool) {
+	if d.adaptive == nil {
+		return
+	}
+	d.adaptive.bytes += n
+	if failed {
+		d.adaptive.errors += 1
+	}
+}
+
+// spawnWorkers starts workers up to the target, or up to the concurrent
+// and the number of batches for a fixed pool.
+func (d *download) spawnWorkers(b chan int64) {
+	d.Lock()
+	defer d.Unlock()
+	if d.adaptive == nil {
+		for d.workers < d.concurrent && d.workers < len(d.batchMap) {
+			d.workers += 1
+			go d.worker(b)
+		}
+		return
+	}
+	for d.adaptive.active < d.adaptive.target {
+		d.adaptive.active += 1
+		go d.worker(b)
+	}
+}
+
+// retire reports whether a worker should exit as there are more workers
+// than the target, or than the concurrent for a fixed pool.
+func (d *download) retire() bool {
+	d.Lock()
+	defer d.Unlock()
+	if d.adaptive == nil {
+		if d.workers > d.concurrent {
+			d.workers -= 1
+			return true
+		}
+		return false
+	}
+	if d.adaptive.active > d.adaptive.target {
+		d.adaptive.active -= 1
+		return true
+	}
+	return false
+}
+
+// control adjusts the target every interval until done is closed.
+func (d *download) control(b chan int64, done chan bool) {
+	ticker := time.NewTicker(d.adaptive.interval)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			d.Lock()
+			previous := d.adaptive.target
+			d.adaptive.adjust(now.Sub(last))
+			target, throughput := d.adaptive.target, d.adaptive.throughput
+			d.Unlock()
+			last = now
+			if target != previous {
+				logger.WithFields(logger.Fields{"source": d.sourceURL, "workers": target, "throughput": int64(throughput)}).Debugf("adjust concurrency")
+			}
+			d.spawnWorkers(b)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package pget
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConcurrency_adjust(t *testing.T) {
+	c := &concurrency{min: 2, max: 5, target: 2}
+	// growing throughput adds a worker
+	c.bytes = 100
+	c.adjust(time.Second)
+	assert.Equal(t, 3, c.target)
+	c.bytes = 200
+	c.adjust(time.Second)
+	assert.Equal(t, 4, c.target)
+	// a drop of the throughput holds
+	c.bytes = 100
+	c.adjust(time.Second)
+	assert.Equal(t, 4, c.target)
+	// failures halve the workers, but not below min
+	c.bytes = 100
+	c.errors = 1
+	c.adjust(time.Second)
+	assert.Equal(t, 2, c.target)
+	c.errors = 1
+	c.adjust(time.Second)
+	assert.Equal(t, 2, c.target)
+	// not above max
+	for i := 0; i < 10; i++ {
+		c.bytes = 1000
+		c.adjust(time.Second)
+	}
+	assert.Equal(t, 5, c.target)
+}
+
+func TestConcurrency_adjustIdle(t *testing.T) {
+	c := &concurrency{min: 1, max: 20, target: 3}
+	c.bytes = 100
+	c.adjust(time.Second)
+	assert.Equal(t, 4, c.target)
+	// paused or a batch still in flight
+	for i := 0; i < 10; i++ {
+		c.adjust(time.Second)
+	}
+	assert.Equal(t, 4, c.target)
+	assert.Equal(t, float64(100), c.throughput)
+}
+
+func TestDownload_retire(t *testing.T) {
+	d := NewDownload("", "", "", 1, "", 1, false, 0, 3)
+	assert.False(t, d.retire())
+	d.SetAdaptiveConcurrency(1, 4)
+	d.adaptive.active = 3
+	d.adaptive.target = 2
+	assert.True(t, d.retire())
+	assert.False(t, d.retire())
+	assert.Equal(t, 2, d.adaptive.active)
+}
+
+func TestDownload_StartAdaptive(t *testing.T) {
+	runTestTrackerServer()
+	f, _ := os.Create("/tmp/adaptive_source")
+	f.WriteString("hello,world")
+	f.Close()
+	defer os.Remove("/tmp/adaptive_source")
+	dst := "/tmp/pget_adaptive"
+	defer os.Remove(dst)
+	d := NewDownload("http://localhost:33345/adaptive_source", "", dst, 1, "", 1, false, 0, 3)
+	d.SetAdaptiveConcurrency(1, 8)
+	d.adaptive.interval = time.Millisecond
+	done := make(chan bool)
+	go func() {
+		d.Start()
+		close(done)
+	}()
+	select {
+	case <-done:
+		buf, _ := ioutil.ReadFile(dst)
+		assert.Equal(t, "hello,world", string(buf))
+	case <-time.After(2e9):
+		assert.True(t, false)
+	}
+}
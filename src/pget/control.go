@@ -0,0 +1,408 @@
+package pget
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	STATE_DOWNLOADING = "downloading"
+	STATE_PAUSED      = "paused"
+	STATE_SEEDING     = "seeding"
+	STATE_STOPPED     = "stopped"
+	// timeout of a request to the control socket
+	CONTROL_TIMEOUT = 10
+)
+
+// Status is the state of a running download served by the control socket.
+type Status struct {
+	Report
+	State string `json:"state"`
+	// batches written and in total
+	Completed int `json:"completed"`
+	Batches   int `json:"batches"`
+	// peers the batches in flight are fetched from
+	Peers []string `json:"peers"`
+	// clients being uploaded to
+	Clients     []string `json:"clients"`
+	Concurrency int      `json:"concurrency"`
+	// bytes per second in effect, 0 is unlimited
+	DownloadRate int64 `json:"download_rate"`
+	UploadRate   int64 `json:"upload_rate"`
+	OriginRate   int64 `json:"origin_rate"`
+	// seconds left to seed, 0 when seeding until stopped
+	SeedRemaining float64 `json:"seed_remaining,omitempty"`
+}
+
+// Pause stops the workers before their next batch, the batches in flight
+// are completed.
+func (d *download) Pause() {
+	d.Lock()
+	d.paused = true
+	d.Unlock()
+}
+
+func (d *download) Resume() {
+	d.Lock()
+	d.paused = false
+	d.pauseCond.Broadcast()
+	d.Unlock()
+}
+
+// waitResume blocks while the download is paused.
+func (d *download) waitResume() {
+	d.Lock()
+	for d.paused {
+		d.pauseCond.Wait()
+	}
+	d.Unlock()
+}
+
+// SetConcurrency changes the number of workers of a running download, it's
+// the max of an adaptive pool. Extra workers exit after their batch.
+func (d *download) SetConcurrency(n int) {
+	if n < 1 {
+		n = 1
+	}
+	d.Lock()
+	if d.adaptive != nil {
+		d.adaptive.max = n
+		if d.adaptive.min > n {
+			d.adaptive.min = n
+		}
+		d.adaptive.target = n
+		d.adaptive.clamp()
+	} else {
+		d.concurrent = n
+	}
+	b := d.batchChan
+	d.Unlock()
+	if b != nil {
+		d.spawnWorkers(b)
+	}
+}
+
+// SetSeedTime changes how long the download is seeded once finished, from
+// now if it's already seeding. A seed started by Seed stops after t.
+func (d *download) SetSeedTime(t time.Duration) {
+	d.Lock()
+	defer d.Unlock()
+	d.uploadTime = int(t / time.Second)
+	if !d.seeding {
+		return
+	}
+	d.seedUntil = time.Now().Add(t)
+	if d.seedTimer == nil {
+		d.seedTimer = time.AfterFunc(t, d.Stop)
+	} else {
+		d.seedTimer.Reset(t)
+	}
+}
+
+// Status returns the state of the download.
+func (d *download) Status() *Status {
+	s := &Status{Report: *d.Report(nil)}
+	s.DownloadRate = d.downloadRateLimit.Rate()
+	s.UploadRate = d.uploadRateLimit.Rate()
+	s.OriginRate = d.originRateLimit.Rate()
+	s.Clients = d.uploadSlots.clientList()
+	stopped := false
+	select {
+	case <-d.closeServer:
+		stopped = true
+	default:
+	}
+	d.Lock()
+	defer d.Unlock()
+	// the download succeeded once it's seeding
+	s.Success = d.seeding
+	switch {
+	case stopped:
+		s.State = STATE_STOPPED
+	case d.seeding:
+		s.State = STATE_SEEDING
+		if d.seedTimer != nil {
+			if left := time.Until(d.seedUntil).Seconds(); left > 0 {
+				s.SeedRemaining = left
+			}
+		}
+	case d.paused:
+		s.State = STATE_PAUSED
+	default:
+		s.State = STATE_DOWNLOADING
+	}
+	s.Batches = len(d.batchMap)
+	for _, done := range d.batchMap {
+		if done {
+			s.Completed += 1
+		}
+	}
+	peers := make(map[string]bool)
+	for _, attempts := range d.inflight {
+		for a := range attempts {
+			if a.peer != "" {
+				peers[a.peer] = true
+			}
+		}
+	}
+	s.Peers = []string{}
+	for peer := range peers {
+		s.Peers = append(s.Peers, peer)
+	}
+	sort.Strings(s.Peers)
+	s.Concurrency = d.concurrent
+	if d.adaptive != nil {
+		s.Concurrency = d.adaptive.target
+	}
+	return s
+}
+
+// Controller serves the control api of the downloads of a process on a unix
+// socket:
+//
+//	GET  /status                              the Status of every download
+//	POST /pause, /resume
+//	POST /rate?download=N&upload=N&origin=N   bytes per second, 0 is unlimited
+//	POST /concurrency?n=N
+//	POST /seed-time?seconds=N
+//	POST /abort?reason=...
+//
+// The commands apply to every download and return their status.
+type Controller struct {
+	sync.Mutex
+	downloads []*download
+	path      string
+	listener  net.Listener
+}
+
+func NewController() *Controller {
+	return &Controller{}
+}
+
+// Add controls d too.
+func (c *Controller) Add(d *download) {
+	c.Lock()
+	c.downloads = append(c.downloads, d)
+	c.Unlock()
+}
+
+// Listen serves the api on the unix socket path in the background, a stale
+// socket left by a dead process is replaced.
+func (c *Controller) Listen(path string) error {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return errors.New(fmt.Sprintf("control socket %s exists and isn't a socket", path))
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return errors.New(fmt.Sprintf("control socket %s is in use", path))
+		}
+		os.Remove(path)
+	}
+	ln, err := listenPrivate(path)
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	c.path, c.listener = path, ln
+	c.Unlock()
+	g.Infof("control socket at %s", path)
+	go http.Serve(ln, c)
+	return nil
+}
+
+// listenPrivate listens on the unix socket path which only the user can
+// connect to. The socket is created in a directory of mode 0700 and moved
+// to path once its mode is set, so it's never open to the others.
+func listenPrivate(path string) (net.Listener, error) {
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".pget-control")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "sock")
+	ln, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	// the socket is removed by Close at its final path
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, 0600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// Close stops serving and removes the socket.
+func (c *Controller) Close() error {
+	c.Lock()
+	defer c.Unlock()
+	if c.listener == nil {
+		return nil
+	}
+	err := c.listener.Close()
+	os.Remove(c.path)
+	c.listener = nil
+	return err
+}
+
+func (c *Controller) list() []*download {
+	c.Lock()
+	defer c.Unlock()
+	return append([]*download(nil), c.downloads...)
+}
+
+func (c *Controller) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/status" {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "invalid method", 405)
+			return
+		}
+		c.writeStatus(w)
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "invalid method", 405)
+		return
+	}
+	downloads := c.list()
+	query := r.URL.Query()
+	switch r.URL.Path {
+	case "/pause":
+		for _, d := range downloads {
+			d.Pause()
+		}
+	case "/resume":
+		for _, d := range downloads {
+			d.Resume()
+		}
+	case "/rate":
+		rates := make(map[string]int64)
+		for _, name := range []string{"download", "upload", "origin"} {
+			if query.Get(name) == "" {
+				continue
+			}
+			n, err := strconv.ParseInt(query.Get(name), 10, 64)
+			if err != nil || n < 0 {
+				http.Error(w, fmt.Sprintf("invalid %s rate:%s", name, query.Get(name)), 400)
+				return
+			}
+			rates[name] = n
+		}
+		for _, d := range downloads {
+			if n, ok := rates["download"]; ok {
+				d.SetDownloadRate(n)
+			}
+			if n, ok := rates["upload"]; ok {
+				d.SetUploadRate(n)
+			}
+			if n, ok := rates["origin"]; ok {
+				d.SetOriginRate(n)
+			}
+		}
+	case "/concurrency":
+		n, err := strconv.Atoi(query.Get("n"))
+		if err != nil || n < 1 {
+			http.Error(w, fmt.Sprintf("invalid concurrency:%s", query.Get("n")), 400)
+			return
+		}
+		for _, d := range downloads {
+			d.SetConcurrency(n)
+		}
+	case "/seed-time":
+		n, err := strconv.Atoi(query.Get("seconds"))
+		if err != nil || n < 0 {
+			http.Error(w, fmt.Sprintf("invalid seed time:%s", query.Get("seconds")), 400)
+			return
+		}
+		for _, d := range downloads {
+			d.SetSeedTime(time.Duration(n) * time.Second)
+		}
+	case "/abort":
+		reason := query.Get("reason")
+		if reason == "" {
+			reason = "control socket"
+		}
+		c.writeStatus(w)
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		// a seed stops cleanly, a download fails
+		for _, d := range downloads {
+			d.Abort(reason)
+		}
+		return
+	default:
+		http.Error(w, "not found", 404)
+		return
+	}
+	g.Infof("control %s %s", r.URL.Path, r.URL.RawQuery)
+	c.writeStatus(w)
+}
+
+func (c *Controller) writeStatus(w http.ResponseWriter) {
+	status := []*Status{}
+	for _, d := range c.list() {
+		status = append(status, d.Status())
+	}
+	w.Header().Set("Content-type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// Control sends command to the control socket of a running process, status
+// is a GET and the others are POST with params.
+func Control(socket string, command string, params url.Values) ([]byte, error) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		},
+		Timeout: CONTROL_TIMEOUT * time.Second,
+	}
+	method := "POST"
+	if command == "status" {
+		method = "GET"
+	}
+	u := "http://pget/" + command
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		return nil, errors.New(fmt.Sprintf("control %s fail, status:%d, %s", command, res.StatusCode, body))
+	}
+	return body, nil
+}
@@ -0,0 +1,146 @@
+package pget
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestController(t *testing.T) {
+	socket := "/tmp/pget_control.sock"
+	d := NewDownload("http://localhost/", "", "", 2, "", 1, false, 0, 3)
+	d.size = 4
+	d.genBatch()
+	d.batchMap[0] = true
+	c := NewController()
+	c.Add(d)
+	assert.NoError(t, c.Listen(socket))
+	defer c.Close()
+	// in use
+	assert.Error(t, NewController().Listen(socket))
+	info, err := os.Stat(socket)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	tmps, _ := filepath.Glob("/tmp/.pget-control*")
+	assert.Len(t, tmps, 0)
+
+	status := func(body []byte) *Status {
+		var s []*Status
+		assert.NoError(t, json.Unmarshal(body, &s))
+		assert.Len(t, s, 1)
+		return s[0]
+	}
+	body, err := Control(socket, "status", nil)
+	assert.NoError(t, err)
+	s := status(body)
+	assert.Equal(t, STATE_DOWNLOADING, s.State)
+	assert.Equal(t, 1, s.Completed)
+	assert.Equal(t, 4, s.Batches)
+	assert.Equal(t, 2, s.Concurrency)
+
+	body, err = Control(socket, "pause", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, STATE_PAUSED, status(body).State)
+	body, err = Control(socket, "resume", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, STATE_DOWNLOADING, status(body).State)
+
+	body, err = Control(socket, "rate", url.Values{"download": {"100"}, "origin": {"50"}})
+	assert.NoError(t, err)
+	s = status(body)
+	assert.Equal(t, int64(100), s.DownloadRate)
+	assert.Equal(t, int64(0), s.UploadRate)
+	assert.Equal(t, int64(50), s.OriginRate)
+
+	body, err = Control(socket, "concurrency", url.Values{"n": {"5"}})
+	assert.NoError(t, err)
+	assert.Equal(t, 5, status(body).Concurrency)
+
+	_, err = Control(socket, "concurrency", url.Values{"n": {"x"}})
+	assert.Error(t, err)
+	_, err = Control(socket, "rate", url.Values{"upload": {"-1"}})
+	assert.Error(t, err)
+	_, err = Control(socket, "unknown", nil)
+	assert.Error(t, err)
+
+	c.Close()
+	_, err = os.Stat(socket)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDownload_SetSeedTime(t *testing.T) {
+	d := NewDownload("http://localhost/", "", "", 1, "", 1, false, 10, 3)
+	d.SetSeedTime(20 * time.Second)
+	assert.Equal(t, 20, d.uploadTime)
+	assert.Nil(t, d.seedTimer)
+
+	d.seeding = true
+	d.SetSeedTime(50 * time.Millisecond)
+	s := d.Status()
+	assert.Equal(t, STATE_SEEDING, s.State)
+	assert.True(t, s.Success)
+	assert.True(t, s.SeedRemaining > 0)
+	select {
+	case <-d.closeServer:
+	case <-time.After(time.Second):
+		assert.True(t, false)
+	}
+	assert.Equal(t, STATE_STOPPED, d.Status().State)
+}
+
+func TestDownload_PauseConcurrency(t *testing.T) {
+	var lock sync.Mutex
+	requests, active, maxActive := 0, 0, 0
+	modTime := time.Now()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests += 1
+		active += 1
+		if active > maxActive {
+			maxActive = active
+		}
+		lock.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		http.ServeContent(w, r, "source", modTime, bytes.NewReader([]byte("hello,world")))
+		lock.Lock()
+		active -= 1
+		lock.Unlock()
+	}))
+	defer ts.Close()
+	dst := "/tmp/pget_pause"
+	defer os.Remove(dst)
+	d := NewDownload(ts.URL, "", dst, 1, "", 1, false, 0, 3)
+	d.Pause()
+	done := make(chan bool)
+	go func() {
+		d.Start()
+		close(done)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	lock.Lock()
+	// only the HEAD request
+	assert.Equal(t, 1, requests)
+	lock.Unlock()
+	d.SetConcurrency(4)
+	d.Resume()
+	select {
+	case <-done:
+		buf, _ := ioutil.ReadFile(dst)
+		assert.Equal(t, "hello,world", string(buf))
+	case <-time.After(5 * time.Second):
+		assert.True(t, false)
+	}
+	lock.Lock()
+	assert.True(t, maxActive > 1)
+	lock.Unlock()
+}
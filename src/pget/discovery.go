@@ -0,0 +1,204 @@
+package pget
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"logger"
+	"net"
+	"strconv"
+	"time"
+	"tracker"
+)
+
+const (
+	// the multicast group the peers announce themselves to
+	DISCOVERY_GROUP = "239.255.42.98:12346"
+	// how often a peer announces itself, sooner when a batch is completed or
+	// a peer is found
+	DISCOVERY_INTERVAL = 5
+	// max size of an announce, the batches are left out of a larger one
+	DISCOVERY_MAX_SIZE = 8192
+)
+
+// discovery finds the peers of the same swarm on the local network.
+type discovery struct {
+	group *net.UDPAddr
+	ifi   *net.Interface
+	// random, to drop the announces of this peer
+	id       string
+	interval time.Duration
+	// asks for an announce
+	kick chan struct{}
+}
+
+// announceMessage is multicast by a peer, swarm identifies the source and
+// its version.
+type announceMessage struct {
+	ID       string `json:"id"`
+	Swarm    string `json:"swarm"`
+	Port     int    `json:"port"`
+	Bitfield []byte `json:"bitfield,omitempty"`
+	// size of the batches of the bitfield
+	BatchSize int64            `json:"batch_size"`
+	Locality  tracker.Locality `json:"locality"`
+}
+
+// SetDiscovery makes the download announce itself and find the peers of the
+// same source by udp multicast to group, DISCOVERY_GROUP if empty, on the
+// interface ifname, the default one if empty. The peers found are used like
+// the ones of the tracker, which isn't required anymore.
+func (d *download) SetDiscovery(group string, ifname string) error {
+	if group == "" {
+		group = DISCOVERY_GROUP
+	}
+	addr, err := net.ResolveUDPAddr("udp4", group)
+	if err != nil {
+		return err
+	}
+	if !addr.IP.IsMulticast() {
+		return errors.New(fmt.Sprintf("discovery group %s isn't a multicast address", group))
+	}
+	var ifi *net.Interface
+	if ifname != "" {
+		if ifi, err = net.InterfaceByName(ifname); err != nil {
+			return err
+		}
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	d.discovery = &discovery{
+		group:    addr,
+		ifi:      ifi,
+		id:       hex.EncodeToString(id),
+		interval: DISCOVERY_INTERVAL * time.Second,
+		kick:     make(chan struct{}, 1),
+	}
+	return nil
+}
+
+// serving reports whether the download uploads to the peers, which needs a
+// way for them to find it.
+func (d *download) serving() bool {
+	return d.upload && (d.th != nil || d.discovery != nil)
+}
+
+// swarmID identifies the source and its version.
+func (d *download) swarmID() string {
+	sum := sha1.Sum([]byte(d.sourceURL + "\n" + d.version()))
+	return hex.EncodeToString(sum[:])
+}
+
+// startDiscovery listens to the announces of the other peers and announces
+// the download until the upload server is closed.
+func (d *download) startDiscovery() {
+	if d.discovery == nil {
+		return
+	}
+	log := logger.WithFields(logger.Fields{"source": d.sourceURL, "group": d.discovery.group.String()})
+	ln, err := net.ListenMulticastUDP("udp4", d.discovery.ifi, d.discovery.group)
+	if err != nil {
+		log.WithField("err", err).Warningf("listen discovery err")
+		return
+	}
+	// the multicast loopback is disabled on ln, the announces are sent from
+	// another socket so the peers of the same host find each other
+	var laddr *net.UDPAddr
+	if d.discovery.ifi != nil {
+		// the source address picks the interface
+		if addrs, err := d.discovery.ifi.Addrs(); err == nil {
+			for _, a := range addrs {
+				if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+					laddr = &net.UDPAddr{IP: ipnet.IP}
+					break
+				}
+			}
+		}
+	}
+	conn, err := net.DialUDP("udp4", laddr, d.discovery.group)
+	if err != nil {
+		ln.Close()
+		log.WithField("err", err).Warningf("dial discovery err")
+		return
+	}
+	log.Infof("discover peers")
+	go d.discoverLoop(ln)
+	go d.announceLoop(conn)
+	go func() {
+		<-d.closeServer
+		ln.Close()
+		conn.Close()
+	}()
+}
+
+// discoverLoop records the peers of the swarm announced to ln.
+func (d *download) discoverLoop(ln *net.UDPConn) {
+	swarm := d.swarmID()
+	buf := make([]byte, 64*1024)
+	for {
+		n, src, err := ln.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		var msg announceMessage
+		if err := json.Unmarshal(buf[:n], &msg); err != nil {
+			continue
+		}
+		if msg.ID == d.discovery.id || msg.Swarm != swarm || msg.Port <= 0 || msg.Port > 65535 {
+			continue
+		}
+		peer := "http://" + net.JoinHostPort(src.IP.String(), strconv.Itoa(msg.Port))
+		// without batches the peer is a contact for the exchange
+		isNew := d.pex.add(peer, msg.Bitfield, msg.BatchSize, time.Now())
+		d.pex.setLocality(peer, msg.Locality)
+		if isNew {
+			// let the new peer know about this one
+			d.kickDiscovery()
+		}
+	}
+}
+
+// announceLoop announces the download every interval, and when a batch is
+// completed or a peer is found at most once a second.
+func (d *download) announceLoop(conn *net.UDPConn) {
+	ticker := time.NewTicker(d.discovery.interval)
+	defer ticker.Stop()
+	var last time.Time
+	for {
+		last = time.Now()
+		msg := announceMessage{ID: d.discovery.id, Swarm: d.swarmID(), Port: d.httpListenPort, Bitfield: d.bitfield(), BatchSize: d.batchSize, Locality: d.locality}
+		content, _ := json.Marshal(msg)
+		if len(content) > DISCOVERY_MAX_SIZE {
+			msg.Bitfield = nil
+			content, _ = json.Marshal(msg)
+		}
+		if _, err := conn.Write(content); err != nil {
+			logger.WithFields(logger.Fields{"source": d.sourceURL, "err": err}).Debugf("announce discovery err")
+		}
+		select {
+		case <-d.closeServer:
+			return
+		case <-ticker.C:
+		case <-d.discovery.kick:
+			select {
+			case <-d.closeServer:
+				return
+			case <-time.After(time.Until(last.Add(time.Second))):
+			}
+		}
+	}
+}
+
+// kickDiscovery announces the download soon.
+func (d *download) kickDiscovery() {
+	if d.discovery == nil {
+		return
+	}
+	select {
+	case d.discovery.kick <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,69 @@
+package pget
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownload_SetDiscovery(t *testing.T) {
+	d := NewDownload("http://localhost/source", "", "", 1, "", 1, true, 0, 3)
+	assert.False(t, d.serving())
+	assert.NoError(t, d.SetDiscovery("", ""))
+	assert.True(t, d.serving())
+	assert.Equal(t, DISCOVERY_GROUP, d.discovery.group.String())
+	assert.Error(t, d.SetDiscovery("127.0.0.1:12346", ""))
+	assert.Error(t, d.SetDiscovery("", "no-such-interface"))
+
+	other := NewDownload("http://localhost/source", "", "", 1, "", 1, true, 0, 3)
+	assert.Equal(t, d.swarmID(), other.swarmID())
+	other.etag = `"v2"`
+	assert.NotEqual(t, d.swarmID(), other.swarmID())
+}
+
+func TestDownload_discovery(t *testing.T) {
+	group := "239.255.42.98:12399"
+	addr, _ := net.ResolveUDPAddr("udp4", group)
+	if ln, err := net.ListenMulticastUDP("udp4", nil, addr); err != nil {
+		t.Skipf("no multicast: %v", err)
+	} else {
+		ln.Close()
+	}
+	if conn, err := net.DialUDP("udp4", nil, addr); err != nil {
+		t.Skipf("no multicast route: %v", err)
+	} else {
+		conn.Close()
+	}
+
+	peer := func(port int, done int64) *download {
+		d := NewDownload("http://localhost/source", "", "", 1, "", 1, true, 0, 3)
+		assert.NoError(t, d.SetDiscovery(group, ""))
+		d.size = 4
+		d.genBatch()
+		d.batchMap[done] = true
+		d.httpListenPort = port
+		return d
+	}
+	a, b := peer(1111, 0), peer(2222, 3)
+	// another swarm
+	c := peer(3333, 0)
+	c.sourceURL = "http://localhost/other"
+	for _, d := range []*download{a, b, c} {
+		d.startDiscovery()
+		defer d.Stop()
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) && (len(a.pex.peersWith(3, 3)) == 0 || len(b.pex.peersWith(0, 0)) == 0) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if len(a.pex.peersWith(3, 3)) == 0 {
+		t.Skip("multicast isn't delivered")
+	}
+	assert.Len(t, a.pex.list(0), 1)
+	_, port, _ := net.SplitHostPort(a.pex.peersWith(3, 3)[0][len("http://"):])
+	assert.Equal(t, "2222", port)
+	assert.Len(t, b.pex.peersWith(0, 0), 1)
+	assert.Len(t, c.pex.list(0), 0)
+}
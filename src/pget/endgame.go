@@ -0,0 +1,156 @@
+package pget
+
+import (
+	"context"
+)
+
+// attempt is a fetch of a batch, several attempts of the same batch run in
+// endgame and the first to complete cancels the others.
+type attempt struct {
+	batch       int64
+	ctx         context.Context
+	cancel      context.CancelFunc
+	speculative bool
+	// the peer being fetched from
+	peer string
+}
+
+// SetEndgame allows up to attempts fetches of the same batch once every
+// batch is dispatched, so the workers left idle race the slow ones. Less
+// than 2 disables the endgame.
+func (d *download) SetEndgame(attempts int) {
+	d.endgame = attempts
+}
+
+// beginAttempt registers an attempt of batch. Must be called with the lock
+// held.
+func (d *download) beginAttempt(batch int64, speculative bool) *attempt {
+	ctx, cancel := context.WithCancel(context.Background())
+	a := &attempt{batch: batch, ctx: ctx, cancel: cancel, speculative: speculative}
+	if d.inflight == nil {
+		d.inflight = make(map[int64]map[*attempt]bool)
+	}
+	if d.inflight[batch] == nil {
+		d.inflight[batch] = make(map[*attempt]bool)
+	}
+	d.inflight[batch][a] = true
+	return a
+}
+
+// endAttempt unregisters a and returns the error of the batch: a failed
+// attempt is only an error if the batch isn't completed and no other
+// attempt of it is running.
+func (d *download) endAttempt(a *attempt, err error) error {
+	a.cancel()
+	d.Lock()
+	defer d.Unlock()
+	delete(d.inflight[a.batch], a)
+	others := len(d.inflight[a.batch])
+	if others == 0 {
+		delete(d.inflight, a.batch)
+	}
+	d.attemptCond.Broadcast()
+	if err == nil || err == ErrSourceChanged {
+		return err
+	}
+	if d.batchMap[a.batch] || others > 0 {
+		return nil
+	}
+	return err
+}
+
+// complete marks the batch of a completed and cancels its other attempts,
+// it returns false if another attempt completed it first.
+func (d *download) complete(a *attempt) bool {
+	d.Lock()
+	defer d.Unlock()
+	if d.batchMap[a.batch] {
+		return false
+	}
+	d.batchMap[a.batch] = true
+	delete(d.pieces, a.batch)
+	for other := range d.inflight[a.batch] {
+		if other != a {
+			other.cancel()
+		}
+	}
+	d.attemptCond.Broadcast()
+	return true
+}
+
+// usePeer records the peer a is fetching from.
+func (d *download) usePeer(a *attempt, peer string) {
+	d.Lock()
+	a.peer = peer
+	d.Unlock()
+}
+
+// orderPeers moves the peers used by the other attempts of the batch to the
+// end, a speculative attempt should race the slow peer from another one.
+func (d *download) orderPeers(a *attempt, peers []string) []string {
+	d.Lock()
+	busy := make(map[string]bool)
+	for other := range d.inflight[a.batch] {
+		if other != a && other.peer != "" {
+			busy[other.peer] = true
+		}
+	}
+	d.Unlock()
+	if len(busy) == 0 {
+		return peers
+	}
+	var free, used []string
+	for _, peer := range peers {
+		if busy[peer] {
+			used = append(used, peer)
+		} else {
+			free = append(free, peer)
+		}
+	}
+	return append(free, used...)
+}
+
+// pickEndgame registers a speculative attempt of the in flight batch with
+// the fewest attempts, it waits for one to be allowed and returns nil when
+// no batch is in flight anymore.
+func (d *download) pickEndgame() *attempt {
+	d.Lock()
+	defer d.Unlock()
+	for {
+		if len(d.inflight) == 0 {
+			return nil
+		}
+		best := int64(-1)
+		for batch, attempts := range d.inflight {
+			if d.batchMap[batch] || len(attempts) >= d.endgame {
+				continue
+			}
+			if best < 0 || len(attempts) < len(d.inflight[best]) ||
+				(len(attempts) == len(d.inflight[best]) && batch < best) {
+				best = batch
+			}
+		}
+		if best >= 0 {
+			return d.beginAttempt(best, true)
+		}
+		d.attemptCond.Wait()
+	}
+}
+
+// endgameWorker races the batches in flight once the queue is empty.
+func (d *download) endgameWorker() {
+	if d.endgame < 2 {
+		return
+	}
+	for {
+		d.waitResume()
+		a := d.pickEndgame()
+		if a == nil {
+			return
+		}
+		d.logBatch(a.batch, "").Debugf("endgame fetch")
+		if err := d.fetchAttempt(a); err != nil {
+			d.fatalf("download batch:%d fail: %v", a.batch, err)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package pget
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownload_StartEndgame(t *testing.T) {
+	var lock sync.Mutex
+	stalled := false
+	modTime := time.Now()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		stall := !stalled && strings.HasPrefix(r.Header.Get("Range"), "bytes=0-")
+		if stall {
+			stalled = true
+		}
+		lock.Unlock()
+		if stall {
+			// a slow peer, until the request is canceled
+			select {
+			case <-r.Context().Done():
+			case <-time.After(10 * time.Second):
+			}
+			return
+		}
+		http.ServeContent(w, r, "source", modTime, bytes.NewReader([]byte("hello,world")))
+	}))
+	defer ts.Close()
+	dst := "/tmp/pget_endgame"
+	defer os.Remove(dst)
+	d := NewDownload(ts.URL, "", dst, 2, "", 4, false, 0, 3)
+	d.SetEndgame(2)
+	done := make(chan bool)
+	go func() {
+		d.Start()
+		close(done)
+	}()
+	select {
+	case <-done:
+		buf, _ := ioutil.ReadFile(dst)
+		assert.Equal(t, "hello,world", string(buf))
+	case <-time.After(5 * time.Second):
+		assert.True(t, false)
+	}
+}
+
+func TestDownload_complete(t *testing.T) {
+	d := NewDownload("", "", "", 1, "", 1, false, 0, 3)
+	d.batchMap = map[int64]bool{0: false}
+	d.Lock()
+	a := d.beginAttempt(0, false)
+	b := d.beginAttempt(0, true)
+	d.Unlock()
+	assert.True(t, d.complete(b))
+	// the loser is canceled and can't complete the batch again
+	assert.NotNil(t, a.ctx.Err())
+	assert.False(t, d.complete(a))
+	assert.Nil(t, d.endAttempt(a, a.ctx.Err()))
+	assert.Nil(t, d.endAttempt(b, nil))
+	assert.Equal(t, 0, len(d.inflight))
+}
+
+func TestDownload_endAttempt(t *testing.T) {
+	d := NewDownload("", "", "", 1, "", 1, false, 0, 3)
+	d.batchMap = map[int64]bool{0: false}
+	d.Lock()
+	a := d.beginAttempt(0, false)
+	b := d.beginAttempt(0, true)
+	d.Unlock()
+	// another attempt is still running
+	assert.Nil(t, d.endAttempt(a, os.ErrNotExist))
+	// the last attempt fails the batch
+	assert.Equal(t, os.ErrNotExist, d.endAttempt(b, os.ErrNotExist))
+}
+
+func TestDownload_orderPeers(t *testing.T) {
+	d := NewDownload("", "", "", 1, "", 1, false, 0, 3)
+	d.Lock()
+	a := d.beginAttempt(0, false)
+	b := d.beginAttempt(0, true)
+	d.Unlock()
+	d.usePeer(a, "http://slow")
+	peers := d.orderPeers(b, []string{"http://slow", "http://other", "http://origin"})
+	assert.Equal(t, []string{"http://other", "http://origin", "http://slow"}, peers)
+}
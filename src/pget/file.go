@@ -0,0 +1,166 @@
+package pget
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	PART_SUFFIX = ".part"
+)
+
+// SetKeepPartial keeps the partial file when the download fails, by default
+// it is removed.
+func (d *download) SetKeepPartial(keep bool) {
+	d.keepPartial = keep
+}
+
+// SetFileMode sets the mode of dst once the download is finished.
+func (d *download) SetFileMode(mode os.FileMode) {
+	d.fileMode = mode
+}
+
+// SetFileOwner sets the owner of dst once the download is finished, -1
+// leaves the uid or gid unchanged.
+func (d *download) SetFileOwner(uid int, gid int) {
+	d.fileUid = uid
+	d.fileGid = gid
+}
+
+// path returns the file being written, the part file until the download is
+// finalized.
+func (d *download) path() string {
+	d.Lock()
+	defer d.Unlock()
+	if d.part != "" {
+		return d.part
+	}
+	return d.dst
+}
+
+// openDst returns the handle of the dst file shared by all the batches,
+// opening it the first time.
+func (d *download) openDst() (f *os.File, err error) {
+	d.Lock()
+	defer d.Unlock()
+	if d.file == nil {
+		path := d.dst
+		if d.part != "" {
+			path = d.part
+		}
+		d.file, err = os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	}
+	return d.file, err
+}
+
+func (d *download) closeDst() {
+	d.Lock()
+	defer d.Unlock()
+	if d.file != nil {
+		d.file.Close()
+		d.file = nil
+	}
+}
+
+// prepareDst makes sure the dst file fits on the disk and preallocates it,
+// so that a full disk is found before downloading anything.
+func (d *download) prepareDst() error {
+	f, err := d.openDst()
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() > d.size {
+		return f.Truncate(d.size)
+	}
+	need := d.size - info.Size()
+	if need == 0 {
+		return nil
+	}
+	if free, err := freeSpace(filepath.Dir(d.dst)); err != nil {
+		g.Warningf("get free space of %s err:%v", d.dst, err)
+	} else if free >= 0 && free < need {
+		return errors.New(fmt.Sprintf("insufficient disk space for %s: need %d bytes, only %d available", d.dst, need, free))
+	}
+	return preallocate(f, d.size)
+}
+
+// finalize syncs the part file and renames it to dst, so dst only ever
+// holds a complete file.
+func (d *download) finalize() error {
+	f, err := d.openDst()
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if d.fileMode != 0 {
+		if err := f.Chmod(d.fileMode); err != nil {
+			return err
+		}
+	}
+	if d.fileUid != -1 || d.fileGid != -1 {
+		if err := f.Chown(d.fileUid, d.fileGid); err != nil {
+			return err
+		}
+	}
+	d.Lock()
+	defer d.Unlock()
+	if err := os.Rename(d.part, d.dst); err != nil {
+		return err
+	}
+	d.part = ""
+	// make the rename durable
+	if dir, err := os.Open(filepath.Dir(d.dst)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// fatalf removes the partial file unless it should be kept and exits.
+func (d *download) fatalf(format string, args ...interface{}) {
+	d.Lock()
+	part := d.part
+	d.Unlock()
+	if part != "" && !d.keepPartial {
+		if err := os.Remove(part); err != nil && !os.IsNotExist(err) {
+			g.Warningf("remove partial file %s err:%v", part, err)
+		}
+	}
+	d.writeReport(errors.New(fmt.Sprintf(format, args...)))
+	g.Fatalf(format, args...)
+}
+
+// Abort stops the download, like a failure. A finished download only stops
+// seeding, Start returns and reports the success.
+func (d *download) Abort(reason string) {
+	d.Lock()
+	finished := d.seeding || !d.stats.end.IsZero()
+	d.Unlock()
+	if finished {
+		g.Infof("stop seeding: %s", reason)
+		d.Stop()
+		return
+	}
+	d.fatalf("download abort: %s", reason)
+}
+
+// offsetWriter writes sequentially to w starting at off.
+type offsetWriter struct {
+	w   io.WriterAt
+	off int64
+}
+
+func (o *offsetWriter) Write(p []byte) (n int, err error) {
+	n, err = o.w.WriteAt(p, o.off)
+	o.off += int64(n)
+	return
+}
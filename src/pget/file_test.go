@@ -0,0 +1,59 @@
+package pget
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownload_prepareDst(t *testing.T) {
+	dst := "/tmp/pget.prealloc"
+	defer os.Remove(dst)
+	d := NewDownload("", "", dst, 1, "", 2, false, 0, 3)
+	d.size = 1024
+	assert.NoError(t, d.prepareDst())
+	d.closeDst()
+	info, err := os.Stat(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, info.Size(), int64(1024))
+
+	d.size = 10
+	assert.NoError(t, d.prepareDst())
+	d.closeDst()
+	info, _ = os.Stat(dst)
+	assert.Equal(t, info.Size(), int64(10))
+}
+
+func TestDownload_prepareDstNoSpace(t *testing.T) {
+	dst := "/tmp/pget.prealloc"
+	defer os.Remove(dst)
+	free, err := freeSpace("/tmp")
+	assert.NoError(t, err)
+	if free < 0 {
+		t.Skip("free space is unknown")
+	}
+	d := NewDownload("", "", dst, 1, "", 2, false, 0, 3)
+	d.size = free + 1<<40
+	assert.Error(t, d.prepareDst())
+	d.closeDst()
+}
+
+func TestDownload_finalize(t *testing.T) {
+	runTestTrackerServer()
+	f, _ := os.Create("/tmp/source")
+	f.WriteString("hello,world")
+	f.Close()
+	defer os.Remove("/tmp/source")
+	dst := "/tmp/pget.final"
+	defer os.Remove(dst)
+	d := NewDownload("http://localhost:33345/source", "", dst, 2, "", 3, false, 0, 3)
+	d.SetFileMode(0640)
+	d.Start()
+	info, err := os.Stat(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, info.Mode().Perm(), os.FileMode(0640))
+	assert.Equal(t, info.Size(), int64(11))
+	_, err = os.Stat(dst + PART_SUFFIX)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,106 @@
+package pget
+
+import (
+	"fmt"
+	"logger"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	HEALTH_BACKOFF     = 1
+	HEALTH_MAX_BACKOFF = 60
+)
+
+// peerHealth keeps peers which are busy or failing out of getPeers for a
+// while, failing peers are backed off exponentially.
+type peerHealth struct {
+	sync.Mutex
+	peers map[string]*peerState
+}
+
+type peerState struct {
+	failures int
+	until    time.Time
+}
+
+func newPeerHealth() *peerHealth {
+	return &peerHealth{peers: make(map[string]*peerState)}
+}
+
+func (h *peerHealth) state(peer string) *peerState {
+	s, ok := h.peers[peer]
+	if !ok {
+		s = &peerState{}
+		h.peers[peer] = s
+	}
+	return s
+}
+
+// busy skips the peer until retryAfter has passed, it isn't a failure.
+func (h *peerHealth) busy(peer string, retryAfter time.Duration) {
+	h.Lock()
+	defer h.Unlock()
+	s := h.state(peer)
+	if until := time.Now().Add(retryAfter); until.After(s.until) {
+		s.until = until
+	}
+}
+
+func (h *peerHealth) fail(peer string) {
+	h.Lock()
+	defer h.Unlock()
+	s := h.state(peer)
+	backoff := time.Duration(HEALTH_MAX_BACKOFF) * time.Second
+	if s.failures < 8 && HEALTH_BACKOFF<<uint(s.failures) < HEALTH_MAX_BACKOFF {
+		backoff = time.Duration(HEALTH_BACKOFF<<uint(s.failures)) * time.Second
+	}
+	s.failures += 1
+	s.until = time.Now().Add(backoff)
+}
+
+func (h *peerHealth) ok(peer string) {
+	h.Lock()
+	defer h.Unlock()
+	delete(h.peers, peer)
+}
+
+func (h *peerHealth) available(peer string) bool {
+	h.Lock()
+	defer h.Unlock()
+	s, ok := h.peers[peer]
+	return !ok || time.Now().After(s.until)
+}
+
+// busyError is returned by downloadBatch when a peer answers 503.
+type busyError struct {
+	peer       string
+	retryAfter time.Duration
+}
+
+func newBusyError(peer string, res *http.Response) *busyError {
+	retryAfter := time.Duration(UPLOAD_RETRY_AFTER) * time.Second
+	if n, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil && n >= 0 {
+		retryAfter = time.Duration(n) * time.Second
+	}
+	return &busyError{peer: peer, retryAfter: retryAfter}
+}
+
+func (e *busyError) Error() string {
+	return fmt.Sprintf("%s is busy, retry after %v", e.peer, e.retryAfter)
+}
+
+// healthyPeers drops the peers which are busy or backed off.
+func (d *download) healthyPeers(peers []string) []string {
+	healthy := peers[:0]
+	for _, peer := range peers {
+		if d.health.available(peer) {
+			healthy = append(healthy, peer)
+		} else {
+			logger.WithFields(logger.Fields{"source": d.sourceURL, "peer": peer}).Debugf("skip unhealthy peer")
+		}
+	}
+	return healthy
+}
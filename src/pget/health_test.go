@@ -0,0 +1,45 @@
+package pget
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeerHealth(t *testing.T) {
+	h := newPeerHealth()
+	assert.True(t, h.available("a"))
+	h.busy("a", time.Hour)
+	assert.False(t, h.available("a"))
+	h.ok("a")
+	assert.True(t, h.available("a"))
+
+	h.fail("b")
+	assert.False(t, h.available("b"))
+	assert.Equal(t, h.peers["b"].failures, 1)
+	h.peers["b"].until = time.Time{}
+	assert.True(t, h.available("b"))
+}
+
+func TestDownload_ServeHTTPBusy(t *testing.T) {
+	d := NewDownload("http://localhost/", "http://localhost", "", 1, "", 1, true, 0, 0)
+	d.httpServer()
+	peer := fmt.Sprintf("http://localhost:%d", d.httpListenPort)
+	res, err := http.Get(peer)
+	assert.NoError(t, err)
+	assert.Equal(t, res.StatusCode, 503)
+	assert.Equal(t, res.Header.Get("Retry-After"), "1")
+
+	d2 := NewDownload("http://localhost/", "", "", 1, "", 1, false, 0, 3)
+	d2.size = 1
+	err = d2.downloadBatch(peer, 0)
+	busy, ok := err.(*busyError)
+	assert.True(t, ok)
+	assert.Equal(t, busy.retryAfter, time.Second)
+	assert.Equal(t, d2.healthyPeers([]string{peer}), []string{peer})
+	d2.health.busy(peer, busy.retryAfter)
+	assert.Len(t, d2.healthyPeers([]string{peer}), 0)
+}
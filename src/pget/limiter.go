@@ -0,0 +1,209 @@
+package pget
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/ratelimit"
+)
+
+// RateRule sets the rate of a Limiter between two times of the day, e.g. to
+// throttle the transfers during business hours. End before Start spans
+// midnight.
+type RateRule struct {
+	// since midnight
+	Start time.Duration
+	End   time.Duration
+	Rate  int64
+}
+
+func (r RateRule) contains(t time.Duration) bool {
+	if r.Start <= r.End {
+		return t >= r.Start && t < r.End
+	}
+	return t >= r.Start || t < r.End
+}
+
+// ParseSchedule parses rules like "09:00-18:00=10,22:00-06:00=50", the rates
+// are multiplied by unit.
+func ParseSchedule(s string, unit int64) (rules []RateRule, err error) {
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		invalid := errors.New(fmt.Sprintf("invalid schedule:%s, should be HH:MM-HH:MM=rate", item))
+		parts := strings.Split(item, "=")
+		if len(parts) != 2 {
+			return nil, invalid
+		}
+		times := strings.Split(parts[0], "-")
+		if len(times) != 2 {
+			return nil, invalid
+		}
+		var rule RateRule
+		if rule.Start, err = parseClock(times[0]); err != nil {
+			return nil, invalid
+		}
+		if rule.End, err = parseClock(times[1]); err != nil {
+			return nil, invalid
+		}
+		if rule.Rate, err = strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64); err != nil || rule.Rate < 0 {
+			return nil, invalid
+		}
+		rule.Rate *= unit
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// parseClock parses HH:MM into the duration since midnight.
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Limiter is a token bucket which can be shared by many transfers, its rate
+// can be changed while they run. A rate of 0 is unlimited.
+type Limiter struct {
+	sync.Mutex
+	rate     int64
+	schedule []RateRule
+	// the bucket of the rate in effect
+	current int64
+	bucket  *ratelimit.Bucket
+	now     func() time.Time
+}
+
+func NewLimiter(rate int64) *Limiter {
+	return &Limiter{rate: rate, now: time.Now}
+}
+
+// SetRate changes the rate out of the schedule.
+func (l *Limiter) SetRate(n int64) {
+	l.Lock()
+	l.rate = n
+	l.Unlock()
+}
+
+// SetSchedule replaces the time of day rules, the first rule matching the
+// local time overrides the rate.
+func (l *Limiter) SetSchedule(rules []RateRule) {
+	l.Lock()
+	l.schedule = rules
+	l.Unlock()
+}
+
+// Rate returns the rate in effect.
+func (l *Limiter) Rate() int64 {
+	l.Lock()
+	defer l.Unlock()
+	return l.effective()
+}
+
+// effective returns the rate at this time of the day. Must be called with
+// the lock held.
+func (l *Limiter) effective() int64 {
+	if len(l.schedule) > 0 {
+		now := l.now()
+		midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+		since := now.Sub(midnight)
+		for _, r := range l.schedule {
+			if r.contains(since) {
+				return r.Rate
+			}
+		}
+	}
+	return l.rate
+}
+
+// take returns the bucket of the rate in effect, nil if unlimited. The
+// bucket is replaced when the rate changes, its burst is one second.
+func (l *Limiter) take() *ratelimit.Bucket {
+	l.Lock()
+	defer l.Unlock()
+	rate := l.effective()
+	if rate <= 0 {
+		l.bucket, l.current = nil, 0
+		return nil
+	}
+	if l.bucket == nil || rate != l.current {
+		l.bucket, l.current = ratelimit.NewBucketWithRate(float64(rate), rate), rate
+	}
+	return l.bucket
+}
+
+// Configure sets the rate and the schedule of l from the options of the
+// rateName and scheduleName flags of a config file, the values are multiplied
+// by unit. A missing option is left unchanged.
+func (l *Limiter) Configure(options map[string][]string, rateName, scheduleName string, unit int64) error {
+	if v, ok := options[rateName]; ok && len(v) > 0 {
+		rate, err := strconv.ParseInt(v[len(v)-1], 10, 64)
+		if err != nil || rate < 0 {
+			return errors.New(fmt.Sprintf("invalid %s:%s", rateName, v[len(v)-1]))
+		}
+		l.SetRate(rate * unit)
+	}
+	if v, ok := options[scheduleName]; ok && len(v) > 0 {
+		rules, err := ParseSchedule(v[len(v)-1], unit)
+		if err != nil {
+			return err
+		}
+		l.SetSchedule(rules)
+	}
+	return nil
+}
+
+// TakeAvailable takes up to n tokens without blocking.
+func (l *Limiter) TakeAvailable(n int64) int64 {
+	if b := l.take(); b != nil {
+		return b.TakeAvailable(n)
+	}
+	return n
+}
+
+// Wait takes n tokens, waiting for them to be available.
+func (l *Limiter) Wait(n int64) {
+	if b := l.take(); b != nil {
+		b.Wait(n)
+	}
+}
+
+// Reader limits the rate of r.
+func (l *Limiter) Reader(r io.Reader) io.Reader {
+	return &limitReader{r: r, l: l}
+}
+
+// Writer limits the rate of w.
+func (l *Limiter) Writer(w io.Writer) io.Writer {
+	return &limitWriter{w: w, l: l}
+}
+
+type limitReader struct {
+	r io.Reader
+	l *Limiter
+}
+
+func (r *limitReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.l.Wait(int64(n))
+	return n, err
+}
+
+type limitWriter struct {
+	w io.Writer
+	l *Limiter
+}
+
+func (w *limitWriter) Write(p []byte) (int, error) {
+	w.l.Wait(int64(len(p)))
+	return w.w.Write(p)
+}
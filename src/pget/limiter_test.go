@@ -0,0 +1,93 @@
+package pget
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSchedule(t *testing.T) {
+	rules, err := ParseSchedule("09:00-18:00=10, 22:00-06:30=0", 100)
+	assert.NoError(t, err)
+	assert.Equal(t, rules, []RateRule{
+		{Start: 9 * time.Hour, End: 18 * time.Hour, Rate: 1000},
+		{Start: 22 * time.Hour, End: 6*time.Hour + 30*time.Minute, Rate: 0},
+	})
+	rules, err = ParseSchedule("", 100)
+	assert.NoError(t, err)
+	assert.Len(t, rules, 0)
+	for _, s := range []string{"09:00=10", "09:00-18:00", "9-18=10", "09:00-25:00=10", "09:00-18:00=-1"} {
+		_, err = ParseSchedule(s, 1)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestLimiter_Schedule(t *testing.T) {
+	l := NewLimiter(100)
+	rules, _ := ParseSchedule("09:00-18:00=10,22:00-06:00=0", 1)
+	l.SetSchedule(rules)
+	at := func(clock string) {
+		c, _ := time.Parse("15:04", clock)
+		l.now = func() time.Time {
+			return time.Date(2020, 1, 1, c.Hour(), c.Minute(), 0, 0, time.Local)
+		}
+	}
+	at("12:00")
+	assert.Equal(t, l.Rate(), int64(10))
+	at("18:00")
+	assert.Equal(t, l.Rate(), int64(100))
+	at("23:00")
+	assert.Equal(t, l.Rate(), int64(0))
+	at("05:59")
+	assert.Equal(t, l.Rate(), int64(0))
+	// unlimited
+	assert.Equal(t, l.TakeAvailable(1000), int64(1000))
+}
+
+func TestLimiter_SetRate(t *testing.T) {
+	l := NewLimiter(0)
+	assert.Equal(t, l.TakeAvailable(1000), int64(1000))
+	l.SetRate(100)
+	assert.Equal(t, l.TakeAvailable(1000), int64(100))
+	assert.Equal(t, l.TakeAvailable(1000), int64(0))
+	// a new rate takes effect at once
+	l.SetRate(200)
+	assert.Equal(t, l.TakeAvailable(1000), int64(200))
+}
+
+func TestLimiter_Shared(t *testing.T) {
+	l := NewLimiter(1000)
+	begin := time.Now()
+	data := strings.Repeat("a", 1000)
+	// the burst of the first second is shared by both
+	n, _ := ioutil.ReadAll(l.Reader(strings.NewReader(data)))
+	var buf bytes.Buffer
+	l.Writer(&buf).Write([]byte(data[:500]))
+	assert.Len(t, n, 1000)
+	assert.Equal(t, buf.Len(), 500)
+	assert.True(t, time.Since(begin) >= 400*time.Millisecond)
+}
+
+func TestLimiter_Configure(t *testing.T) {
+	l := NewLimiter(100)
+	assert.NoError(t, l.Configure(map[string][]string{"download-schedule": {"00:00-23:59=2"}}, "download-rate", "download-schedule", 10))
+	assert.Equal(t, l.rate, int64(100))
+	assert.Len(t, l.schedule, 1)
+	assert.NoError(t, l.Configure(map[string][]string{"download-rate": {"5"}, "download-schedule": {""}}, "download-rate", "download-schedule", 10))
+	assert.Equal(t, l.Rate(), int64(50))
+	assert.Error(t, l.Configure(map[string][]string{"download-rate": {"x"}}, "download-rate", "download-schedule", 10))
+}
+
+func TestDownload_SetOriginRate(t *testing.T) {
+	d := NewDownload("http://localhost/", "http://localhost", "", 1, "", 0, true, 0, 3)
+	d.SetOriginRate(100)
+	assert.Equal(t, d.originRateLimit.Rate(), int64(100))
+	shared := NewLimiter(10)
+	d.SetDownloadLimiter(shared)
+	d.SetDownloadRate(20)
+	assert.Equal(t, shared.Rate(), int64(20))
+}
@@ -0,0 +1,277 @@
+package pget
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"logger"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"tracker"
+)
+
+const (
+	MANIFEST_PATH = "/.well-known/pget/manifest/"
+	// max tracker requests per second of an origin
+	ORIGIN_ANNOUNCE_RATE = 50
+	// every how many heartbeats all the batches of the unchanged files are
+	// announced again, e.g. to a restarted tracker
+	ORIGIN_FULL_ANNOUNCE = 12
+)
+
+// Manifest describes a file served by an Origin, the batch checksums let a
+// client verify each batch on its own.
+type Manifest struct {
+	Path      string   `json:"path"`
+	Size      int64    `json:"size"`
+	MD5       string   `json:"md5"`
+	BatchSize int64    `json:"batch_size"`
+	Batches   []string `json:"batches"`
+}
+
+// manifestEntry is the manifest of a file of size and modTime.
+type manifestEntry struct {
+	size     int64
+	modTime  time.Time
+	manifest *Manifest
+}
+
+// Origin serves a static dir like http.FileServer, with the same upload
+// limits and metrics as a pget peer. With a tracker, it announces every
+// file it serves as a peer of its own url, so it takes part in the swarm.
+type Origin struct {
+	sync.Mutex
+	dir                  string
+	baseURL              string
+	trackerURL           string
+	trackerRequestHeader [][2]string
+	batchSize            int64
+	heartbeat            time.Duration
+	locality             tracker.Locality
+	uploadRateLimit      *Limiter
+	uploadSlots          *uploadSlots
+	files                http.Handler
+	// the manifest of the latest version of each file
+	manifests map[string]*manifestEntry
+	// the versions of the files whose batches are announced
+	announced map[string]os.FileInfo
+}
+
+// NewOrigin serves dir, baseURL is the url of dir as the downloaders see it,
+// which is the source the files are announced for.
+func NewOrigin(dir string, baseURL string, trackerURL string, batchSize int64, uploadConcurrent int) *Origin {
+	return &Origin{
+		dir:             dir,
+		baseURL:         strings.TrimRight(baseURL, "/"),
+		trackerURL:      trackerURL,
+		batchSize:       batchSize,
+		uploadSlots:     newUploadSlots(uploadConcurrent),
+		uploadRateLimit: NewLimiter(0),
+		files:           http.FileServer(http.Dir(dir)),
+		manifests:       make(map[string]*manifestEntry),
+		announced:       make(map[string]os.FileInfo),
+	}
+}
+
+// SetUploadRate sets the upload rate limit, it can be changed while serving.
+func (o *Origin) SetUploadRate(n int64) {
+	o.uploadRateLimit.SetRate(n)
+}
+
+// SetUploadLimiter replaces the upload limiter, e.g. to set a schedule. It
+// must be called before serving.
+func (o *Origin) SetUploadLimiter(l *Limiter) {
+	o.uploadRateLimit = l
+}
+
+func (o *Origin) SetUploadQueueTime(t time.Duration) {
+	o.uploadSlots.queueTime = t
+}
+
+func (o *Origin) SetHeartbeat(t time.Duration) {
+	o.heartbeat = t
+}
+
+// SetLocality sets the topology labels the files are announced with, e.g.
+// dc=us-east,zone=us-east-1a.
+func (o *Origin) SetLocality(labels string) (err error) {
+	o.locality, err = tracker.ParseLocality(labels)
+	return err
+}
+
+func (o *Origin) SetTrackerRequestHeader(params []string) {
+	o.trackerRequestHeader = append(o.trackerRequestHeader, parseHeader(params)...)
+}
+
+func (o *Origin) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if o.trackerURL != "" {
+		if o.baseURL == "" {
+			return errors.New("base url is required to register to the tracker")
+		}
+		go o.register(ln.Addr().(*net.TCPAddr).Port)
+	}
+	g.Infof("listen at %s", ln.Addr())
+	return http.Serve(tcpKeepAliveListener{ln.(*net.TCPListener)}, o)
+}
+
+// register announces the files every heartbeat, all their batches every
+// ORIGIN_FULL_ANNOUNCE heartbeats.
+func (o *Origin) register(port int) {
+	heartbeat := o.heartbeat
+	if heartbeat <= 0 {
+		heartbeat = SEED_HEARTBEAT * time.Second
+	}
+	for n := 0; ; n++ {
+		o.announceAll(port, n%ORIGIN_FULL_ANNOUNCE == 0)
+		time.Sleep(heartbeat)
+	}
+}
+
+// announceAll announces all the batches of the new and changed files, and
+// of all the files if full. An unchanged file is announced by one batch,
+// which keeps it from expiring in the tracker. The requests are paced at
+// ORIGIN_ANNOUNCE_RATE.
+func (o *Origin) announceAll(port int, full bool) {
+	tick := time.NewTicker(time.Second / ORIGIN_ANNOUNCE_RATE)
+	defer tick.Stop()
+	seen := make(map[string]bool)
+	filepath.Walk(o.dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(o.dir, file)
+		if err != nil {
+			return nil
+		}
+		peerPath := (&url.URL{Path: "/" + filepath.ToSlash(rel)}).EscapedPath()
+		th := &tracker.TrackerHelper{
+			SourceURL:  o.baseURL + peerPath,
+			TrackerURL: o.trackerURL,
+			// the Last-Modified of http.FileServer
+			Version:       info.ModTime().UTC().Format(http.TimeFormat),
+			PeerPath:      peerPath,
+			Locality:      o.locality,
+			RequestHeader: o.trackerRequestHeader,
+		}
+		seen[file] = true
+		batches := (info.Size() + o.batchSize - 1) / o.batchSize
+		from := int64(0)
+		if last, ok := o.announced[file]; ok && !full && batches > 0 && last.Size() == info.Size() && last.ModTime().Equal(info.ModTime()) {
+			from = batches - 1
+		}
+		delete(o.announced, file)
+		for batch := from; batch < batches; batch++ {
+			<-tick.C
+			if err := th.PutPeer(strconv.Itoa(port), batch, o.batchSize); err != nil {
+				logger.WithFields(logger.Fields{"source": th.SourceURL, "batch": batch, "tracker": o.trackerURL, "err": err}).Warningf("announce err")
+				return nil
+			}
+		}
+		o.announced[file] = info
+		logger.WithFields(logger.Fields{"source": th.SourceURL, "bytes": info.Size(), "batches": batches - from}).Debugf("announce file")
+		return nil
+	})
+	// the removed files
+	for file := range o.announced {
+		if !seen[file] {
+			delete(o.announced, file)
+		}
+	}
+}
+
+// manifest returns the manifest of the file at urlPath in batches of the
+// origin, it is cached until the file changes.
+func (o *Origin) manifest(urlPath string) (*Manifest, error) {
+	urlPath = path.Clean("/" + urlPath)
+	file := filepath.Join(o.dir, filepath.FromSlash(urlPath))
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, os.ErrNotExist
+	}
+	o.Lock()
+	e, ok := o.manifests[file]
+	o.Unlock()
+	if ok && e.size == info.Size() && e.modTime.Equal(info.ModTime()) {
+		return e.manifest, nil
+	}
+	md5, batches, err := BatchMD5sums(file, o.batchSize)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{Path: urlPath, Size: info.Size(), MD5: md5, BatchSize: o.batchSize, Batches: batches}
+	o.Lock()
+	// replaces the manifest of an older version
+	o.manifests[file] = &manifestEntry{size: info.Size(), modTime: info.ModTime(), manifest: m}
+	o.Unlock()
+	return m, nil
+}
+
+func (o *Origin) serveManifest(w http.ResponseWriter, r *http.Request) {
+	// only the batches of the origin, a small batch_size would make the
+	// manifest as large as the file
+	if bs := r.URL.Query().Get("batch_size"); bs != "" && bs != strconv.FormatInt(o.batchSize, 10) {
+		w.WriteHeader(400)
+		w.Write([]byte(fmt.Sprintf("invalid batch_size, the origin serves %d", o.batchSize)))
+		return
+	}
+	m, err := o.manifest(strings.TrimPrefix(r.URL.Path, MANIFEST_PATH))
+	if os.IsNotExist(err) {
+		w.WriteHeader(404)
+		w.Write([]byte("not found"))
+		return
+	} else if err != nil {
+		g.Error(err)
+		w.WriteHeader(500)
+		w.Write([]byte("error"))
+		return
+	}
+	w.Header().Set("Content-type", "application/json")
+	json.NewEncoder(w).Encode(m)
+}
+
+func (o *Origin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == METRICS_PATH {
+		o.uploadSlots.serveMetrics(w)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, MANIFEST_PATH) {
+		o.serveManifest(w, r)
+		return
+	}
+	client := remoteHost(r)
+	if !o.uploadSlots.acquire(client, nil) {
+		g.Warningf("upload conn is greater than upload concurrent:%d", o.uploadSlots.concurrent)
+		w.Header().Set("Retry-After", strconv.Itoa(UPLOAD_RETRY_AFTER))
+		w.WriteHeader(503)
+		w.Write([]byte("upload conn is full"))
+		return
+	}
+	defer o.uploadSlots.release(client)
+	o.files.ServeHTTP(&limitResponseWriter{ResponseWriter: w, w: o.uploadSlots.writer(w, o.uploadRateLimit)}, r)
+}
+
+// limitResponseWriter sends the body through w.
+type limitResponseWriter struct {
+	http.ResponseWriter
+	w io.Writer
+}
+
+func (l *limitResponseWriter) Write(p []byte) (int, error) {
+	return l.w.Write(p)
+}
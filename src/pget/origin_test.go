@@ -0,0 +1,121 @@
+package pget
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+	"tracker"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrigin_manifest(t *testing.T) {
+	dir := "/tmp/pget-origin"
+	os.MkdirAll(dir+"/sub", 0755)
+	defer os.RemoveAll(dir)
+	f, _ := os.Create(dir + "/sub/test.txt")
+	f.WriteString("hello,wrold")
+	f.Close()
+	o := NewOrigin(dir, "http://origin.com/", "", 6, 3)
+
+	w := httptest.NewRecorder()
+	o.ServeHTTP(w, httptest.NewRequest("GET", MANIFEST_PATH+"sub/test.txt", nil))
+	assert.Equal(t, w.Code, 200)
+	var m Manifest
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&m))
+	assert.Equal(t, m.Path, "/sub/test.txt")
+	assert.Equal(t, m.Size, int64(11))
+	assert.Equal(t, m.MD5, "2e9dd21c7bf65eb6c8337e58c658d44c")
+	assert.Len(t, m.Batches, 2)
+
+	w = httptest.NewRecorder()
+	o.ServeHTTP(w, httptest.NewRequest("GET", MANIFEST_PATH+"sub/test.txt?batch_size=6", nil))
+	assert.Equal(t, w.Code, 200)
+	w = httptest.NewRecorder()
+	o.ServeHTTP(w, httptest.NewRequest("GET", MANIFEST_PATH+"sub/test.txt?batch_size=1", nil))
+	assert.Equal(t, w.Code, 400)
+
+	// a new version replaces the cached one
+	assert.Len(t, o.manifests, 1)
+	ioutil.WriteFile(dir+"/sub/test.txt", []byte("hello,world"), 0644)
+	os.Chtimes(dir+"/sub/test.txt", time.Now(), time.Now().Add(time.Hour))
+	w = httptest.NewRecorder()
+	o.ServeHTTP(w, httptest.NewRequest("GET", MANIFEST_PATH+"sub/test.txt", nil))
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&m))
+	assert.Equal(t, m.MD5, "3cb95cfbe1035bce8c448fcaf80fe7d9")
+	assert.Len(t, o.manifests, 1)
+
+	w = httptest.NewRecorder()
+	o.ServeHTTP(w, httptest.NewRequest("GET", MANIFEST_PATH+"../../etc/passwd", nil))
+	assert.Equal(t, w.Code, 404)
+}
+
+func TestOrigin_ServeHTTP(t *testing.T) {
+	dir := "/tmp/pget-origin"
+	os.MkdirAll(dir, 0755)
+	defer os.RemoveAll(dir)
+	f, _ := os.Create(dir + "/test.txt")
+	f.WriteString("hello,world")
+	f.Close()
+	o := NewOrigin(dir, "http://origin.com", "", 6, 1)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/test.txt", nil)
+	r.Header.Set("Range", "bytes=6-")
+	o.ServeHTTP(w, r)
+	assert.Equal(t, w.Code, 206)
+	assert.Equal(t, w.Body.String(), "world")
+
+	o.uploadSlots.acquire("other", nil)
+	w = httptest.NewRecorder()
+	o.ServeHTTP(w, httptest.NewRequest("GET", "/test.txt", nil))
+	assert.Equal(t, w.Code, 503)
+
+	w = httptest.NewRecorder()
+	o.ServeHTTP(w, httptest.NewRequest("GET", METRICS_PATH, nil))
+	var m uploadMetrics
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&m))
+	assert.Equal(t, m.Requests, int64(2))
+	assert.Equal(t, m.Rejected, int64(1))
+	assert.Equal(t, m.Bytes, int64(5))
+}
+
+func TestOrigin_announceAll(t *testing.T) {
+	runTestTrackerServer()
+	dir := "/tmp/pget-origin"
+	os.MkdirAll(dir, 0755)
+	defer os.RemoveAll(dir)
+	f, _ := os.Create(dir + "/announce.txt")
+	f.WriteString("hello,world")
+	f.Close()
+	info, _ := os.Stat(dir + "/announce.txt")
+	o := NewOrigin(dir, "http://origin.com", "http://localhost:22345", 6, 1)
+	o.announceAll(8080, false)
+
+	th := tracker.TrackerHelper{
+		SourceURL:  "http://origin.com/announce.txt",
+		TrackerURL: "http://localhost:22345",
+		Version:    info.ModTime().UTC().Format(http.TimeFormat),
+	}
+	peers, err := th.GetPeer(1, 6)
+	assert.NoError(t, err)
+	assert.Equal(t, peers, []string{"http://127.0.0.1:8080/announce.txt"})
+
+	// an unchanged file is announced by its last batch only
+	o.announceAll(8081, false)
+	peers, _ = th.GetPeer(0, 6)
+	assert.Equal(t, peers, []string{"http://127.0.0.1:8080/announce.txt"})
+	peers, _ = th.GetPeer(1, 6)
+	assert.Len(t, peers, 2)
+	o.announceAll(8081, true)
+	peers, _ = th.GetPeer(0, 6)
+	assert.Len(t, peers, 2)
+
+	os.Remove(dir + "/announce.txt")
+	o.announceAll(8081, false)
+	assert.Len(t, o.announced, 0)
+}
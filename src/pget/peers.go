@@ -0,0 +1,76 @@
+package pget
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+	"tracker"
+)
+
+// SetPeers adds peers known to have the file, e.g. http://host:port, they
+// are tried for every batch before the origin, with or without tracker.
+func (d *download) SetPeers(peers []string) error {
+	for _, peer := range peers {
+		if err := checkPeer(peer); err != nil {
+			return err
+		}
+		peer = strings.TrimRight(peer, "/")
+		d.staticPeers = append(d.staticPeers, peer)
+		// contacts for the exchange
+		d.pex.add(peer, nil, 0, time.Now())
+	}
+	return nil
+}
+
+// checkPeer returns an error unless peer is an http or https url with a
+// host and a port, and without user info, query or fragment. The batch
+// requests to a peer carry the download headers.
+func checkPeer(peer string) error {
+	u, err := url.Parse(peer)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" || u.Port() == "" ||
+		u.User != nil || strings.ContainsAny(peer, "?#") {
+		return errors.New(fmt.Sprintf("invalid peer:%s", peer))
+	}
+	return nil
+}
+
+// SetLocality sets the topology labels of the download, e.g.
+// dc=us-east,zone=us-east-1a,rack=r12, announced to the tracker and the
+// peers. The nearest peers are tried first, the ones in another datacenter
+// are skipped if denyCrossDC, the peers of unknown datacenter are kept.
+func (d *download) SetLocality(labels string, denyCrossDC bool) error {
+	l, err := tracker.ParseLocality(labels)
+	if err != nil {
+		return err
+	}
+	if denyCrossDC && l.DC == "" {
+		return errors.New("dc label is required to deny the peers of another dc")
+	}
+	d.locality = l
+	d.denyCrossDC = denyCrossDC
+	if d.th != nil {
+		d.th.Locality = l
+		d.th.DenyCrossDC = denyCrossDC
+	}
+	return nil
+}
+
+// ReadPeersFile returns the peers of a file, one per line, the blank lines
+// and the ones starting with # are skipped.
+func ReadPeersFile(path string) (peers []string, err error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		peers = append(peers, line)
+	}
+	return peers, nil
+}
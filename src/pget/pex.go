@@ -0,0 +1,372 @@
+package pget
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"logger"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"tracker"
+)
+
+const (
+	PEX_PATH = "/.well-known/pget/pex"
+	// how often a peer exchanges its peers with PEX_FANOUT others
+	PEX_INTERVAL = 10
+	PEX_FANOUT   = 3
+	// a peer not heard of for PEX_TTL seconds is forgotten
+	PEX_TTL = 300
+	// max peers sent and read in an exchange
+	PEX_MAX_PEERS = 50
+	// max size of an exchange request or response
+	PEX_MAX_SIZE = 16 << 20
+)
+
+// pexMessage is exchanged by the peers: the request carries the port and
+// the batches of the requester, the response the batches of the server and
+// the peers it knows.
+type pexMessage struct {
+	Port    int    `json:"port,omitempty"`
+	Version string `json:"version"`
+	// bit i is set when batch i of BatchSize is completed
+	Bitfield  []byte    `json:"bitfield"`
+	BatchSize int64     `json:"batch_size"`
+	Peers     []pexPeer `json:"peers,omitempty"`
+	// the url of the requester as seen by the server
+	You      string           `json:"you,omitempty"`
+	Locality tracker.Locality `json:"locality"`
+}
+
+type pexPeer struct {
+	URL       string `json:"url"`
+	Bitfield  []byte `json:"bitfield"`
+	BatchSize int64  `json:"batch_size"`
+	// seconds since it was heard of
+	Age      float64          `json:"age"`
+	Locality tracker.Locality `json:"locality"`
+}
+
+// pexEntry is a peer, its batches may be of another size than the ones of
+// the download.
+type pexEntry struct {
+	bitfield  []byte
+	batchSize int64
+	seen      time.Time
+	locality  tracker.Locality
+}
+
+// pexStore are the peers learned by peer exchange and their batches, a
+// peer of unknown batches is only a contact for the exchange.
+type pexStore struct {
+	sync.Mutex
+	peers map[string]*pexEntry
+	// the urls of this peer as seen by the others
+	self map[string]bool
+}
+
+func newPexStore() *pexStore {
+	return &pexStore{peers: make(map[string]*pexEntry), self: make(map[string]bool)}
+}
+
+// add records peer heard of at seen with its batches of batchSize, a nil
+// bitfield keeps the known one and an older news is ignored. It reports
+// whether the peer is new.
+func (s *pexStore) add(peer string, bitfield []byte, batchSize int64, seen time.Time) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.self[peer] || time.Since(seen) > PEX_TTL*time.Second {
+		return false
+	}
+	if batchSize <= 0 {
+		bitfield = nil
+	}
+	e := s.peers[peer]
+	if e == nil {
+		s.peers[peer] = &pexEntry{bitfield: bitfield, batchSize: batchSize, seen: seen}
+		return true
+	}
+	if seen.Before(e.seen) {
+		if e.bitfield == nil && bitfield != nil {
+			e.bitfield, e.batchSize = bitfield, batchSize
+		}
+		return false
+	}
+	e.seen = seen
+	if bitfield != nil {
+		e.bitfield, e.batchSize = bitfield, batchSize
+	}
+	return false
+}
+
+// setLocality records the labels of a known peer, empty ones keep the known
+// labels.
+func (s *pexStore) setLocality(peer string, l tracker.Locality) {
+	s.Lock()
+	defer s.Unlock()
+	if e := s.peers[peer]; e != nil && !l.IsZero() {
+		e.locality = l
+	}
+}
+
+// locality returns the labels of peer, empty if unknown.
+func (s *pexStore) locality(peer string) tracker.Locality {
+	s.Lock()
+	defer s.Unlock()
+	if e := s.peers[peer]; e != nil {
+		return e.locality
+	}
+	return tracker.Locality{}
+}
+
+func (s *pexStore) remove(peer string) {
+	s.Lock()
+	delete(s.peers, peer)
+	s.Unlock()
+}
+
+// setSelf records a url of this peer, it's never returned as a peer.
+func (s *pexStore) setSelf(peer string) {
+	s.Lock()
+	s.self[peer] = true
+	delete(s.peers, peer)
+	s.Unlock()
+}
+
+// expire forgets the peers not heard of for PEX_TTL.
+func (s *pexStore) expire() {
+	s.Lock()
+	defer s.Unlock()
+	for peer, e := range s.peers {
+		if time.Since(e.seen) > PEX_TTL*time.Second {
+			delete(s.peers, peer)
+		}
+	}
+}
+
+// peersWith returns the peers having the bytes from start to end, the most
+// recently heard of first.
+func (s *pexStore) peersWith(start int64, end int64) (peers []string) {
+	for _, p := range s.list(0) {
+		if hasRange(p.Bitfield, p.BatchSize, start, end) {
+			peers = append(peers, p.URL)
+		}
+	}
+	return peers
+}
+
+// list returns up to max peers, the most recently heard of first, 0 is no
+// max.
+func (s *pexStore) list(max int) []pexPeer {
+	s.Lock()
+	defer s.Unlock()
+	peers := []pexPeer{}
+	for peer, e := range s.peers {
+		peers = append(peers, pexPeer{URL: peer, Bitfield: e.bitfield, BatchSize: e.batchSize, Age: time.Since(e.seen).Seconds(), Locality: e.locality})
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Age < peers[j].Age
+	})
+	if max > 0 && len(peers) > max {
+		peers = peers[:max]
+	}
+	return peers
+}
+
+// targets returns up to n random peers to exchange with.
+func (s *pexStore) targets(n int) []string {
+	s.Lock()
+	defer s.Unlock()
+	var peers []string
+	for peer := range s.peers {
+		peers = append(peers, peer)
+	}
+	rand.Shuffle(len(peers), func(i, j int) {
+		peers[i], peers[j] = peers[j], peers[i]
+	})
+	if len(peers) > n {
+		peers = peers[:n]
+	}
+	return peers
+}
+
+func hasBatch(bitfield []byte, batch int64) bool {
+	i := batch / 8
+	return batch >= 0 && i < int64(len(bitfield)) && bitfield[i]&(1<<uint(batch%8)) != 0
+}
+
+// hasRange reports whether the batches of batchSize covering the bytes from
+// start to end are all set.
+func hasRange(bitfield []byte, batchSize int64, start int64, end int64) bool {
+	if batchSize <= 0 || start > end {
+		return false
+	}
+	for batch := start / batchSize; batch <= end/batchSize; batch++ {
+		if !hasBatch(bitfield, batch) {
+			return false
+		}
+	}
+	return true
+}
+
+// bitfield returns the completed batches.
+func (d *download) bitfield() []byte {
+	d.Lock()
+	defer d.Unlock()
+	bitfield := make([]byte, (len(d.batchMap)+7)/8)
+	for batch, done := range d.batchMap {
+		if done {
+			bitfield[batch/8] |= 1 << uint(batch%8)
+		}
+	}
+	return bitfield
+}
+
+// SetPexInterval sets how often the peers are exchanged, 0 disables the
+// exchange with the other peers, the requests are still served.
+func (d *download) SetPexInterval(t time.Duration) {
+	d.pexInterval = t
+}
+
+// servePex records the requester and returns the known peers.
+func (d *download) servePex(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(405)
+		w.Write([]byte("invalid method"))
+		return
+	}
+	var req pexMessage
+	r.Body = http.MaxBytesReader(w, r.Body, PEX_MAX_SIZE)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Port <= 0 || req.Port > 65535 {
+		w.WriteHeader(400)
+		w.Write([]byte("invalid pex request"))
+		return
+	}
+	if req.Version != d.version() {
+		w.WriteHeader(409)
+		w.Write([]byte("version mismatch"))
+		return
+	}
+	peer := "http://" + net.JoinHostPort(remoteHost(r), strconv.Itoa(req.Port))
+	d.pex.add(peer, req.Bitfield, req.BatchSize, time.Now())
+	d.pex.setLocality(peer, req.Locality)
+	res := pexMessage{Version: d.version(), Bitfield: d.bitfield(), BatchSize: d.batchSize, You: peer, Locality: d.locality}
+	for _, p := range d.pex.list(PEX_MAX_PEERS + 1) {
+		if p.URL != peer && len(res.Peers) < PEX_MAX_PEERS {
+			res.Peers = append(res.Peers, p)
+		}
+	}
+	w.Header().Set("Content-type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// pexURL returns the pex endpoint of a peer url.
+func pexURL(peer string) (string, error) {
+	u, err := url.Parse(peer)
+	if err != nil || u.Host == "" {
+		return "", errors.New(fmt.Sprintf("invalid peer:%s", peer))
+	}
+	return u.Scheme + "://" + u.Host + PEX_PATH, nil
+}
+
+// exchange sends the batches of the download to peer and records the peers
+// it knows.
+func (d *download) exchange(peer string) error {
+	if err := checkPeer(peer); err != nil {
+		return err
+	}
+	u, err := pexURL(peer)
+	if err != nil {
+		return err
+	}
+	body, _ := json.Marshal(pexMessage{Port: d.httpListenPort, Version: d.version(), Bitfield: d.bitfield(), BatchSize: d.batchSize, Locality: d.locality})
+	ctx, cancel := context.WithTimeout(context.Background(), HEAD_TIMEOUT*time.Second)
+	defer cancel()
+	req, err := http.NewRequest("POST", u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-type", "application/json")
+	res, err := d.client().Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		content, _ := ioutil.ReadAll(res.Body)
+		return errors.New(fmt.Sprintf("http code is %d, body is %s", res.StatusCode, content))
+	}
+	var msg pexMessage
+	if err := json.NewDecoder(io.LimitReader(res.Body, PEX_MAX_SIZE)).Decode(&msg); err != nil {
+		return err
+	}
+	// only a url of this peer, else a peer could make it drop any other
+	if msg.You != "" && isSelf(msg.You, d.httpListenPort) {
+		d.pex.setSelf(msg.You)
+	}
+	now := time.Now()
+	d.pex.add(peer, msg.Bitfield, msg.BatchSize, now)
+	d.pex.setLocality(peer, msg.Locality)
+	for i, p := range msg.Peers {
+		if i >= PEX_MAX_PEERS {
+			break
+		}
+		// the swarm would send the download headers to any url
+		if err := checkPeer(p.URL); err != nil {
+			logger.WithFields(logger.Fields{"source": d.sourceURL, "peer": peer, "err": err}).Debugf("skip exchanged peer")
+			continue
+		}
+		// an age out of range would keep the peer forever
+		age := p.Age
+		if age < 0 {
+			age = 0
+		} else if age > PEX_TTL {
+			age = PEX_TTL
+		}
+		d.pex.add(p.URL, p.Bitfield, p.BatchSize, now.Add(-time.Duration(age*float64(time.Second))))
+		d.pex.setLocality(p.URL, p.Locality)
+	}
+	return nil
+}
+
+// isSelf reports whether peer is an url of the upload server listening on
+// port.
+func isSelf(peer string, port int) bool {
+	u, err := url.Parse(peer)
+	return err == nil && port > 0 && u.Port() == strconv.Itoa(port)
+}
+
+// pexLoop exchanges the peers every pexInterval until the upload server is
+// closed.
+func (d *download) pexLoop() {
+	if d.pexInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(d.pexInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.closeServer:
+			return
+		case <-ticker.C:
+		}
+		d.pex.expire()
+		for _, peer := range d.pex.targets(PEX_FANOUT) {
+			if err := d.exchange(peer); err != nil {
+				logger.WithFields(logger.Fields{"source": d.sourceURL, "peer": peer, "err": err}).Debugf("exchange peers err")
+				d.pex.remove(peer)
+			}
+		}
+	}
+}
@@ -1,48 +1,41 @@
 package pget
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"logger"
-	"net"
 	"net/http"
 	"os"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
 	"tracker"
-
-	"github.com/juju/ratelimit"
 )
 
 const (
 	BATCH_TIMEOUT  = 30
 	HEAD_TIMEOUT   = 10
 	DOWNLOAD_RETRY = 3
+	BUSY_RETRY     = 10
 )
 
 var g = logger.GetLogger()
 
-// tcpKeepAliveListener sets TCP keep-alive timeouts on accepted
-// connections. It's used by ListenAndServe and ListenAndServeTLS so
-// dead TCP connections (e.g. closing laptop mid-download) eventually
-// go away.
-type tcpKeepAliveListener struct {
-	*net.TCPListener
-}
+// ErrSourceChanged is returned when the origin file no longer matches the
+// version recorded by getSize, e.g. it was replaced in the middle of a download.
+var ErrSourceChanged = errors.New("source changed during download")
 
-func (ln tcpKeepAliveListener) Accept() (c net.Conn, err error) {
-	tc, err := ln.AcceptTCP()
-	if err != nil {
-		return
-	}
-	tc.SetKeepAlive(true)
-	tc.SetKeepAlivePeriod(3 * time.Minute)
-	return tc, nil
-}
+// ErrRangeUnsupported is returned when the origin answers a range request
+// with the whole file of the same version.
+var ErrRangeUnsupported = errors.New("origin doesn't support range requests")
+
+// errMissingBatch is returned when a peer doesn't have the batch yet, it
+// isn't a failure of the peer.
+var errMissingBatch = errors.New("peer doesn't have the batch")
 
 type download struct {
 	sourceURL  string
@@ -56,58 +49,169 @@ type download struct {
 	wg        sync.WaitGroup
 	batchSize int64
 	th        *tracker.TrackerHelper
+	// version of the source recorded by getSize
+	etag         string
+	lastModified string
+	// shared handle of dst
+	file *os.File
+	// dst is written to part until finalize
+	part        string
+	keepPartial bool
+	fileMode    os.FileMode
+	fileUid     int
+	fileGid     int
 	// close http server
 	closeServer    chan bool
+	closeOnce      sync.Once
 	httpWg         sync.WaitGroup
 	httpListenPort int
 	// upload
 	upload bool
 	// upload time
 	uploadTime int
-	// download rate limit
-	downloadRateLimit *ratelimit.Bucket
-	downloadRate      int64
-	// upload rate limit
-	uploadRateLimit *ratelimit.Bucket
-	uploadRate      int64
+	// how often a seed announces its batches
+	heartbeat time.Duration
+	// rate limits, the origin one applies to the origin requests on top of
+	// the download one
+	downloadRateLimit *Limiter
+	uploadRateLimit   *Limiter
+	originRateLimit   *Limiter
 	// upload concurrent
 	uploadConcurrent int
-	// current upload conn
-	curUploadConn int
+	// upload conns and metrics
+	uploadSlots *uploadSlots
+	// busy and failing peers
+	health *peerHealth
 	// http header
 	downloadRequestHeader [][2]string
 	trackerRequestHeader  [][2]string
+	// stream output, batches are written to it in order
+	stream        io.Writer
+	streamWindow  int
+	streamSlots   chan struct{}
+	streamPending map[int64][]byte
+	streamCond    *sync.Cond
+	streamDone    chan bool
+	streamHash    hash.Hash
+	// the next batch streamLoop writes
+	streamNext int64
+	// batch requests
+	timeouts   timeouts
+	clientOnce sync.Once
+	httpClient *http.Client
+	// tuning of the transport of httpClient
+	transportOptions TransportOptions
+	// bytes per second of a batch request
+	throughput float64
+	// attempts of the batches in flight, endgame is the max of a batch,
+	// attemptCond is signaled when an attempt or a piece ends
+	inflight    map[int64]map[*attempt]bool
+	endgame     int
+	attemptCond *sync.Cond
+	// progress of the batches fetched in pieces
+	pieceSize int64
+	pieces    map[int64]*batchPieces
+	// adaptive worker pool, nil for a fixed concurrent
+	adaptive *concurrency
+	// the queue of dispatch and the workers of a fixed concurrent
+	batchChan chan int64
+	workers   int
+	// paused workers wait on pauseCond before the next batch
+	paused    bool
+	pauseCond *sync.Cond
+	// seeding after the download until seedTimer stops the upload server,
+	// a seed without timer runs until Stop
+	seeding   bool
+	seedUntil time.Time
+	seedTimer *time.Timer
+	// peers learned by peer exchange
+	pex         *pexStore
+	pexInterval time.Duration
+	// multicast discovery of the peers, nil if disabled
+	discovery *discovery
+	// peers given by the user
+	staticPeers []string
+	// topology labels, the nearest peers are tried first and the ones in
+	// another datacenter skipped if denyCrossDC
+	locality    tracker.Locality
+	denyCrossDC bool
+	// report file and the stats written to it
+	report     string
+	reportOnce sync.Once
+	stats      downloadStats
 }
 
 func NewDownload(sourceURL, trackerURL, dst string, concurrent int, md5 string, batchSize int64, upload bool, uploadTime int, uploadConcurrent int) *download {
 	d := &download{
-		sourceURL:        sourceURL,
-		trackerURL:       trackerURL,
-		dst:              dst,
-		concurrent:       concurrent,
-		md5:              md5,
-		wg:               sync.WaitGroup{},
-		batchSize:        batchSize,
-		closeServer:      make(chan bool),
-		httpWg:           sync.WaitGroup{},
-		upload:           upload,
-		uploadTime:       uploadTime,
-		uploadConcurrent: uploadConcurrent,
-	}
+		sourceURL:         sourceURL,
+		trackerURL:        trackerURL,
+		dst:               dst,
+		concurrent:        concurrent,
+		md5:               md5,
+		wg:                sync.WaitGroup{},
+		batchSize:         batchSize,
+		closeServer:       make(chan bool),
+		httpWg:            sync.WaitGroup{},
+		upload:            upload,
+		uploadTime:        uploadTime,
+		uploadConcurrent:  uploadConcurrent,
+		uploadSlots:       newUploadSlots(uploadConcurrent),
+		health:            newPeerHealth(),
+		pex:               newPexStore(),
+		pexInterval:       PEX_INTERVAL * time.Second,
+		fileUid:           -1,
+		fileGid:           -1,
+		downloadRateLimit: NewLimiter(0),
+		uploadRateLimit:   NewLimiter(0),
+		originRateLimit:   NewLimiter(0),
+		timeouts: timeouts{
+			connect:   CONNECT_TIMEOUT * time.Second,
+			firstByte: FIRST_BYTE_TIMEOUT * time.Second,
+			idle:      IDLE_TIMEOUT * time.Second,
+			batch:     BATCH_TIMEOUT * time.Second,
+		},
+	}
+	d.attemptCond = sync.NewCond(&d.Mutex)
+	d.pauseCond = sync.NewCond(&d.Mutex)
 	if d.trackerURL != "" && d.upload {
 		d.th = &tracker.TrackerHelper{SourceURL: d.sourceURL, TrackerURL: d.trackerURL}
 	}
 	return d
 }
 
+// SetDownloadRate sets the download rate limit, it can be changed while
+// the download runs. 0 is unlimited.
 func (d *download) SetDownloadRate(n int64) {
-	d.downloadRate = n
-	d.downloadRateLimit = ratelimit.NewBucketWithRate(float64(n), n)
+	d.downloadRateLimit.SetRate(n)
 }
 
 func (d *download) SetUploadRate(n int64) {
-	d.uploadRate = n
-	d.uploadRateLimit = ratelimit.NewBucketWithRate(float64(n), n)
+	d.uploadRateLimit.SetRate(n)
+}
+
+// SetOriginRate limits the requests to the origin, to protect its link.
+func (d *download) SetOriginRate(n int64) {
+	d.originRateLimit.SetRate(n)
+}
+
+// SetDownloadLimiter replaces the download limiter, e.g. with one shared
+// by several downloads. It must be called before the download starts.
+func (d *download) SetDownloadLimiter(l *Limiter) {
+	d.downloadRateLimit = l
+}
+
+func (d *download) SetUploadLimiter(l *Limiter) {
+	d.uploadRateLimit = l
+}
+
+func (d *download) SetOriginLimiter(l *Limiter) {
+	d.originRateLimit = l
+}
+
+// SetUploadQueueTime sets how long an upload request waits for a free
+// upload conn before it is answered 503.
+func (d *download) SetUploadQueueTime(t time.Duration) {
+	d.uploadSlots.queueTime = t
 }
 
 func (d *download) SetTrackerRequestHeader(params []string) {
@@ -115,61 +219,97 @@ func (d *download) SetTrackerRequestHeader(params []string) {
 		g.Warning("dont't set tracker or disable upload")
 		return
 	}
-	for _, param := range params {
-		header := strings.Split(param, ":")
-		if len(header) != 2 {
-			g.Warningf("invalid header:%s", param)
-			continue
-		}
-		d.trackerRequestHeader = append(d.trackerRequestHeader, [2]string{header[0], header[1]})
-
-	}
+	d.trackerRequestHeader = append(d.trackerRequestHeader, parseHeader(params)...)
 	d.th.RequestHeader = d.trackerRequestHeader
 }
 
 func (d *download) SetDownloadRequestHeader(params []string) {
+	d.downloadRequestHeader = append(d.downloadRequestHeader, parseHeader(params)...)
+}
+
+// parseHeader parses "key:value" headers, invalid ones are skipped.
+func parseHeader(params []string) (headers [][2]string) {
 	for _, param := range params {
 		header := strings.Split(param, ":")
 		if len(header) != 2 {
 			g.Warningf("invalid header:%s", param)
 			continue
 		}
-		d.downloadRequestHeader = append(d.downloadRequestHeader, [2]string{header[0], header[1]})
+		headers = append(headers, [2]string{header[0], header[1]})
 
 	}
+	return headers
 }
 
 func (d *download) Start() {
+	d.Lock()
+	d.stats.begin = time.Now()
+	d.Unlock()
 	if err := d.getSize(); err != nil {
-		g.Fatalf("get file size error:%v", err)
+		d.fatalf("get file size error:%v", err)
+	}
+	if d.dst != "" {
+		if d.stream == nil {
+			d.part = d.dst + PART_SUFFIX
+		}
+		if err := d.prepareDst(); err != nil {
+			d.fatalf("prepare dst error:%v", err)
+		}
+		defer d.closeDst()
 	}
 	d.genBatch()
-	if d.th != nil {
+	if d.serving() {
 		d.httpServer()
+		go d.pexLoop()
+		d.startDiscovery()
+	}
+	if d.stream != nil {
+		d.startStream()
 	}
 	d.dispatch()
+	if d.stream != nil {
+		<-d.streamDone
+	}
 	if d.md5 != "" {
-		md5, err := MD5sum(d.dst)
+		md5, err := d.checksum()
 		if err != nil {
-			g.Fatal(err)
+			d.fatalf("%v", err)
 		}
 		if strings.ToLower(md5) != strings.ToLower(d.md5) {
-			g.Fatal("md5 verify fail")
+			d.setChecksum(CHECKSUM_FAIL)
+			d.fatalf("md5 verify fail")
 		} else {
+			d.setChecksum(CHECKSUM_PASS)
 			g.Infof("md5 verify pass")
 		}
 	}
+	if d.part != "" {
+		if err := d.finalize(); err != nil {
+			d.fatalf("finalize %s error:%v", d.dst, err)
+		}
+	}
+	d.Lock()
+	d.stats.end = time.Now()
+	d.Unlock()
 	g.Info("download finish")
-	if d.th != nil {
-		go func() {
-			time.Sleep(time.Duration(d.uploadTime * 1e9))
-			close(d.closeServer)
-
-		}()
+	if d.serving() {
+		d.Lock()
+		d.seeding = true
+		d.seedUntil = time.Now().Add(time.Duration(d.uploadTime) * time.Second)
+		d.seedTimer = time.AfterFunc(time.Duration(d.uploadTime)*time.Second, d.Stop)
+		d.Unlock()
 		<-d.closeServer
 		g.Info("close http server")
 		d.httpWg.Wait()
 	}
+	d.writeReport(nil)
+}
+
+func (d *download) checksum() (string, error) {
+	if d.stream != nil {
+		return d.streamMD5(), nil
+	}
+	return MD5sum(d.path())
 }
 
 func (d *download) genBatch() {
@@ -189,32 +329,100 @@ func (d *download) genBatch() {
 
 func (d *download) worker(b chan int64) {
 	for {
-
+		d.waitResume()
+		if d.retire() {
+			return
+		}
 		batch, ok := <-b
 		if !ok {
+			d.endgameWorker()
 			return
 		}
-		success := false
-		for i := 1; i <= DOWNLOAD_RETRY && !success; i++ {
-			for _, peer := range d.getPeers(batch) {
-				if err := d.downloadBatch(peer, batch); err == nil {
-					success = true
-					g.Debugf("fetch batch:%d from:%s success .. \n", batch, peer)
-					d.Lock()
-					d.batchMap[batch] = true
-					d.Unlock()
-					d.wg.Done()
-					d.announce(batch)
-					break
-				} else {
-					g.Warningf("fetch batch:%d from:%s err: %v.. \n", batch, peer, err)
+		if err := d.fetchBatch(batch); err != nil {
+			d.fatalf("download batch:%d fail: %v", batch, err)
+		}
+	}
+}
+
+// fetchBatch tries every peer of the batch up to DOWNLOAD_RETRY times, then
+// marks the batch completed and announces it.
+func (d *download) fetchBatch(batch int64) error {
+	d.Lock()
+	a := d.beginAttempt(batch, false)
+	d.Unlock()
+	return d.fetchAttempt(a)
+}
+
+func (d *download) fetchAttempt(a *attempt) (err error) {
+	defer func() {
+		err = d.endAttempt(a, err)
+	}()
+	if d.usePieces(a.batch) {
+		return d.fetchPiecesAttempt(a)
+	}
+	batch := a.batch
+	busyRetry := 0
+	for i := 1; i <= DOWNLOAD_RETRY; {
+		// a round where every peer is busy doesn't count as an attempt
+		allBusy := true
+		var wait time.Duration
+		for _, peer := range d.orderPeers(a, d.getPeers(batch)) {
+			if a.ctx.Err() != nil {
+				// another attempt completed the batch
+				return a.ctx.Err()
+			}
+			begin := time.Now()
+			d.usePeer(a, peer)
+			err = d.downloadBatchContext(a.ctx, peer, batch)
+			d.usePeer(a, "")
+			log := d.logBatch(batch, peer).WithField("duration", time.Since(begin))
+			if err == nil {
+				if !d.complete(a) {
+					log.Debugf("batch is completed by another attempt")
+					return nil
+				}
+				start, end := d.genRange(batch)
+				log.WithField("bytes", end-start+1).WithField("speculative", a.speculative).Debugf("fetch batch success")
+				d.recordBatch(peer, end-start+1)
+				d.observeThroughput(end-start+1, time.Since(begin))
+				d.health.ok(peer)
+				d.wg.Done()
+				d.announce(batch)
+				return nil
+			} else if err == ErrSourceChanged || err == ErrRangeUnsupported {
+				return err
+			} else if a.ctx.Err() != nil {
+				return err
+			} else if err == errMissingBatch {
+				// try the next one, the peer may have it later
+				allBusy = false
+				d.recordRetry(peer, false)
+				log.Debugf("peer doesn't have the batch")
+			} else if busy, ok := err.(*busyError); ok {
+				log.WithField("err", err).Debugf("peer is busy")
+				d.recordRetry(peer, false)
+				d.health.busy(peer, busy.retryAfter)
+				if wait == 0 || busy.retryAfter < wait {
+					wait = busy.retryAfter
 				}
+			} else {
+				allBusy = false
+				d.health.fail(peer)
+				d.recordRetry(peer, true)
+				log.WithField("err", err).Warningf("fetch batch err")
 			}
 		}
-		if !success {
-			g.Fatalf("download batch:%d fail", batch)
+		if allBusy && busyRetry < BUSY_RETRY {
+			busyRetry += 1
+			select {
+			case <-time.After(wait):
+			case <-a.ctx.Done():
+			}
+			continue
 		}
+		i++
 	}
+	return err
 }
 
 func (d *download) dispatch() {
@@ -222,15 +430,29 @@ func (d *download) dispatch() {
 	length := len(d.batchMap)
 	d.Unlock()
 	batchChan := make(chan int64)
-	for i := 1; i <= d.concurrent && i <= length; i++ {
-		go d.worker(batchChan)
+	d.Lock()
+	d.batchChan = batchChan
+	d.Unlock()
+	if d.adaptive != nil {
+		done := make(chan bool)
+		defer close(done)
+		d.startAdaptive(batchChan, done)
+	} else {
+		d.spawnWorkers(batchChan)
 	}
 	for k := 0; k < length; k++ {
+		if d.streamSlots != nil {
+			d.streamSlots <- struct{}{}
+		}
 		batchChan <- int64(k)
 	}
 
-	d.wg.Wait()
+	// the idle workers turn to the endgame
 	close(batchChan)
+	d.wg.Wait()
+	d.Lock()
+	d.batchChan = nil
+	d.Unlock()
 }
 
 func (d *download) setHeader(req *http.Request) {
@@ -249,8 +471,9 @@ func (d *download) getSize() (err error) {
 		return
 	}
 	d.setHeader(req)
-	hc := &http.Client{Timeout: time.Duration(time.Second * HEAD_TIMEOUT)}
-	res, err := hc.Do(req)
+	ctx, cancel := context.WithTimeout(req.Context(), time.Duration(time.Second*HEAD_TIMEOUT))
+	defer cancel()
+	res, err := d.client().Do(req.WithContext(ctx))
 	if err != nil {
 		return
 	}
@@ -259,11 +482,49 @@ func (d *download) getSize() (err error) {
 	if res.StatusCode != 200 {
 		return errors.New(fmt.Sprintf("response http code should be 200, but real is %d", res.StatusCode))
 	}
+	// Status may read them meanwhile
+	d.Lock()
 	d.size = res.ContentLength
+	d.etag = res.Header.Get("Etag")
+	d.lastModified = res.Header.Get("Last-Modified")
+	d.Unlock()
+	if d.th != nil {
+		d.th.Version = d.version()
+	}
 	return
 
 }
 
+// version returns the identifier of the source version being downloaded,
+// the ETag if the origin sent one, otherwise its Last-Modified time.
+func (d *download) version() string {
+	if d.etag != "" {
+		return d.etag
+	}
+	return d.lastModified
+}
+
+// ifRange returns the validator to send in the If-Range header, weak
+// ETags are not allowed there so fall back to Last-Modified.
+func (d *download) ifRange() string {
+	if d.etag != "" && !strings.HasPrefix(d.etag, "W/") {
+		return d.etag
+	}
+	return d.lastModified
+}
+
+// checkVersion verifies that a 206 response belongs to the version recorded
+// by getSize.
+func (d *download) checkVersion(res *http.Response) bool {
+	if d.etag != "" && res.Header.Get("Etag") != "" {
+		return res.Header.Get("Etag") == d.etag
+	}
+	if d.lastModified != "" && res.Header.Get("Last-Modified") != "" {
+		return res.Header.Get("Last-Modified") == d.lastModified
+	}
+	return true
+}
+
 func (d *download) genRange(batch int64) (start int64, end int64) {
 	start = batch * d.batchSize
 	end = start + d.batchSize - 1
@@ -275,190 +536,147 @@ func (d *download) genRange(batch int64) (start int64, end int64) {
 }
 
 func (d *download) announce(batch int64) {
+	d.kickDiscovery()
 	if d.th != nil {
 		if err := d.th.PutPeer(fmt.Sprintf("%d", d.httpListenPort), batch, d.batchSize); err != nil {
-			g.Warningf("announce url:%s err:%v", d.trackerURL, err)
+			d.logBatch(batch, "").WithField("tracker", d.trackerURL).WithField("err", err).Warningf("announce err")
 		}
 	}
 }
 
+// logBatch returns a log entry with the source, batch and peer fields, peer
+// is omitted when empty.
+func (d *download) logBatch(batch int64, peer string) *logger.Entry {
+	fields := logger.Fields{"source": d.sourceURL, "batch": batch}
+	if peer != "" {
+		fields["peer"] = peer
+	}
+	return logger.WithFields(fields)
+}
+
+// getPeers returns the peers of batch from the tracker, then the ones known
+// by peer exchange, which keep the swarm sharing when the tracker is down,
+// and the static peers, the nearest first, and the origin last.
 func (d *download) getPeers(batch int64) (peers []string) {
 	if d.th != nil {
-		if peerFromTracker, err := d.th.GetPeer(batch, d.batchSize); err != nil {
-			g.Warningf("get peer:%v", err)
+		if peerFromTracker, locality, err := d.th.GetPeerLocality(batch, d.batchSize); err != nil {
+			d.logBatch(batch, "").WithField("tracker", d.trackerURL).WithField("err", err).Warningf("get peer err")
 		} else {
+			now := time.Now()
+			for _, peer := range peerFromTracker {
+				// contacts for the exchange
+				d.pex.add(peer, nil, 0, now)
+				d.pex.setLocality(peer, locality[peer])
+			}
 			peers = append(peers, peerFromTracker...)
 		}
 	}
+	known := make(map[string]bool)
+	for _, peer := range peers {
+		known[peer] = true
+	}
+	start, end := d.genRange(batch)
+	for _, peer := range append(d.pex.peersWith(start, end), d.staticPeers...) {
+		if !known[peer] {
+			known[peer] = true
+			peers = append(peers, peer)
+		}
+	}
+	peers = tracker.Nearest(peers, d.locality, !d.denyCrossDC, d.pex.locality)
+	peers = d.healthyPeers(peers)
 	peers = append(peers, d.sourceURL)
-	g.Debugf("peers for batch:%d is %v", batch, peers)
+	d.logBatch(batch, "").WithField("peers", strings.Join(peers, ",")).Debugf("get peers")
 	return peers
 }
 
-func (d *download) downloadBatch(url string, batch int64) (err error) {
+func (d *download) downloadBatch(url string, batch int64) error {
+	return d.downloadBatchContext(context.Background(), url, batch)
+}
 
-	g.Debugf("will fetch batch:%d from:%s.. \n", batch, url)
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return
-	}
-	d.setHeader(req)
+// downloadBatchContext fetches batch from url, it's stopped when ctx is
+// canceled.
+func (d *download) downloadBatchContext(ctx context.Context, url string, batch int64) (err error) {
+
+	d.logBatch(batch, url).Debugf("will fetch batch")
 	start, end := d.genRange(batch)
-	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
-	hc := &http.Client{Timeout: time.Duration(time.Second * BATCH_TIMEOUT)}
-	res, err := hc.Do(req)
+	src, closeBody, err := d.requestRange(ctx, url, start, end)
 	if err != nil {
 		return
 	}
-	defer res.Body.Close()
-	if res.StatusCode != 206 {
-		return errors.New(fmt.Sprintf("response http code should be 206, but real is %d", res.StatusCode))
+	defer closeBody()
+	if d.stream != nil {
+		return d.streamBatch(batch, start, end, src)
 	}
-	f, err := os.OpenFile(d.dst, os.O_CREATE|os.O_WRONLY, 0600)
+	f, err := d.openDst()
 	if err != nil {
-		g.Fatal(err)
+		d.fatalf("%v", err)
 	}
-	_, err = f.Seek(start, 0)
+	n, err := io.Copy(&offsetWriter{w: f, off: start}, src)
 	if err != nil {
-		g.Fatal(err)
+		return err
 	}
-	defer f.Close()
-	var src io.Reader
-	if d.downloadRateLimit != nil {
-		src = ratelimit.Reader(res.Body, d.downloadRateLimit)
-	} else {
-		src = res.Body
-	}
-	n, err := io.Copy(f, src)
 	if n != end-start+1 {
 		return errors.New("invalid length")
 	}
-	return err
+	return nil
 }
 
-func (d *download) parseRange(rangeHeader string) (batch int64, err error) {
-	rangeHeader = rangeHeader[len("bytes="):]
-	rangeArray := strings.Split(rangeHeader, "-")
-	if len(rangeArray) != 2 {
-		return 0, errors.New(fmt.Sprintf("invalid range header:%s", rangeHeader))
-	}
-	start, err := strconv.ParseInt(rangeArray[0], 10, 0)
-	if err != nil {
-		return 0, errors.New(fmt.Sprintf("invalid range header: %v ", err))
-	}
-	end, err := strconv.ParseInt(rangeArray[1], 10, 0)
+// requestRange requests the bytes start-end of the source from url, the body
+// is limited by the idle timeout and the download rate. closeBody must be
+// called once done with it.
+func (d *download) requestRange(ctx context.Context, url string, start int64, end int64) (src io.Reader, closeBody func(), err error) {
+	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		return 0, errors.New(fmt.Sprintf("invalid range header: %v ", err))
-	}
-	if start%d.batchSize != 0 {
-		return 0, errors.New(fmt.Sprintf("invalid range start %d, start mod batch_size must be zero", start))
+		return
 	}
-	if end-start >= d.batchSize {
-		return 0, errors.New(fmt.Sprintf("invalid range end %d, range size greater than batch size", end))
-
+	d.setHeader(req)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	origin := url == d.sourceURL
+	if origin && d.ifRange() != "" {
+		req.Header.Set("If-Range", d.ifRange())
 	}
-	return start / d.batchSize, nil
-
-}
-
-func (d *download) httpServer() {
-
-	srv := &http.Server{Addr: ":0", Handler: d}
-
-	ln, err := net.Listen("tcp", srv.Addr)
+	ctx, cancel := context.WithTimeout(ctx, d.batchDeadline(end-start+1))
+	res, err := d.client().Do(req.WithContext(ctx))
 	if err != nil {
-		g.Fatal(err)
-	}
-	d.httpListenPort = ln.Addr().(*net.TCPAddr).Port
-	g.Infof("listen at :%d", d.httpListenPort)
-	go srv.Serve(tcpKeepAliveListener{ln.(*net.TCPListener)})
-}
-
-func (d *download) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-
-	select {
-	case <-d.closeServer:
-		g.Info("receive close singal, will return")
-		w.WriteHeader(500)
-		w.Write([]byte("close connection"))
+		cancel()
 		return
-	default:
 	}
-
-	d.Lock()
-	if d.curUploadConn < d.uploadConcurrent {
-		d.curUploadConn += 1
-		d.Unlock()
-	} else {
-		d.Unlock()
-		g.Warningf("upload conn is greater than upload concurrent:%d", d.uploadConcurrent)
-		w.WriteHeader(500)
-		w.Write([]byte("upload conn is full"))
-		return
+	closeRes := func() {
+		res.Body.Close()
+		cancel()
 	}
-
-	d.httpWg.Add(1)
 	defer func() {
-		d.httpWg.Done()
-		d.Lock()
-		d.curUploadConn -= 1
-		d.Unlock()
+		if err != nil {
+			closeRes()
+		}
 	}()
-
-	w.Header().Set("Content-type", "application/octet-stream")
-	rangeHeader := r.Header.Get("Range")
-	if rangeHeader == "" {
-		w.WriteHeader(500)
-		w.Write([]byte("invalid range"))
-		return
+	if origin && res.StatusCode == 200 && req.Header.Get("If-Range") != "" {
+		// the origin ignores the range when If-Range doesn't match, or
+		// when it doesn't support ranges
+		if !d.checkVersion(res) {
+			return nil, nil, ErrSourceChanged
+		}
+		return nil, nil, ErrRangeUnsupported
 	}
-	batch, err := d.parseRange(rangeHeader)
-	if err != nil {
-		g.Warning(err)
-		w.WriteHeader(500)
-		w.Write([]byte("invalid range"))
+	if res.StatusCode == 503 {
+		return nil, nil, newBusyError(url, res)
 	}
-	d.Lock()
-	ok := d.batchMap[batch]
-	d.Unlock()
-	if !ok {
-		g.Warningf("batch:%d is not completed", batch)
-		w.WriteHeader(500)
-		w.Write([]byte("batch is not completed"))
-		return
+	if !origin && res.StatusCode == 404 {
+		return nil, nil, errMissingBatch
 	}
-	f, err := os.Open(d.dst)
-	if err != nil {
-		g.Error(f)
-		w.WriteHeader(500)
-		w.Write([]byte("error"))
-		return
-	}
-	start, end := d.genRange(batch)
-	defer f.Close()
-	f.Seek(start, 0)
-	length := end - start + 1
-	buf := make([]byte, length)
-	n, err := f.Read(buf)
-	if err != nil {
-		g.Error(err)
-		w.WriteHeader(500)
-		w.Write([]byte("error"))
-		return
+	if res.StatusCode != 206 {
+		return nil, nil, errors.New(fmt.Sprintf("response http code should be 206, but real is %d", res.StatusCode))
 	}
-	if int64(n) != length {
-		g.Error("batch length is not euqal buf from read file")
-		w.WriteHeader(500)
-		w.Write([]byte("error"))
-		return
-
+	if !d.checkVersion(res) {
+		if origin {
+			return nil, nil, ErrSourceChanged
+		}
+		return nil, nil, errors.New(fmt.Sprintf("peer version mismatch, want %s", d.version()))
 	}
-	w.WriteHeader(206)
-	var dst io.Writer
-	if d.uploadRateLimit != nil {
-		dst = ratelimit.Writer(w, d.uploadRateLimit)
-	} else {
-		dst = w
+	src = newIdleReader(res.Body, d.timeouts.idle, cancel)
+	src = d.downloadRateLimit.Reader(src)
+	if origin {
+		src = d.originRateLimit.Reader(src)
 	}
-	dst.Write(buf)
+	return src, closeRes, nil
 }
@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"sync"
 	"time"
 	"tracker"
@@ -70,22 +72,149 @@ func TestDownload_parseRange(t *testing.T) {
 
 	batch_size := 3
 	d := NewDownload("", "", "", 1, "", int64(batch_size), false, 0, 3)
+	d.size = 10
+
+	ranges, err := d.parseRange("bytes=0-2")
+	assert.NoError(t, err)
+	assert.Equal(t, ranges, []httpRange{{0, 3}})
+
+	ranges, err = d.parseRange("bytes=3-5")
+	assert.NoError(t, err)
+	assert.Equal(t, ranges, []httpRange{{3, 3}})
+
+	ranges, err = d.parseRange("bytes=1-7")
+	assert.NoError(t, err)
+	assert.Equal(t, ranges, []httpRange{{1, 7}})
+
+	ranges, err = d.parseRange("bytes=8-20")
+	assert.NoError(t, err)
+	assert.Equal(t, ranges, []httpRange{{8, 2}})
 
-	batch, err := d.parseRange("bytes=0-2")
+	ranges, err = d.parseRange("bytes=7-")
 	assert.NoError(t, err)
-	assert.Equal(t, batch, int64(0))
+	assert.Equal(t, ranges, []httpRange{{7, 3}})
 
-	batch, err = d.parseRange("bytes=3-5")
+	ranges, err = d.parseRange("bytes=-4")
 	assert.NoError(t, err)
-	assert.Equal(t, batch, int64(1))
+	assert.Equal(t, ranges, []httpRange{{6, 4}})
 
-	batch, err = d.parseRange("bytes=0-3")
+	ranges, err = d.parseRange("bytes=0-1, 4-5,-1")
+	assert.NoError(t, err)
+	assert.Equal(t, ranges, []httpRange{{0, 2}, {4, 2}, {9, 1}})
+
+	_, err = d.parseRange("bytes=10-12")
+	assert.Equal(t, err, errNoOverlap)
+
+	_, err = d.parseRange("bytes=5-3")
+	assert.Error(t, err)
+
+	_, err = d.parseRange("bytes=0-ttt")
 	assert.Error(t, err)
-	assert.Equal(t, batch, int64(0))
 
-	batch, err = d.parseRange("bytes=0-ttt")
+	_, err = d.parseRange("items=0-1")
 	assert.Error(t, err)
-	assert.Equal(t, batch, int64(0))
+	// the ranges can't add up to more than the file
+	_, err = d.parseRange("bytes=0-,0-,0-")
+	assert.Error(t, err)
+	d.size = 1000
+	_, err = d.parseRange("bytes=" + strings.Repeat("0-0,", MAX_RANGES))
+	assert.NoError(t, err)
+	_, err = d.parseRange("bytes=" + strings.Repeat("0-0,", MAX_RANGES+1))
+	assert.Error(t, err)
+}
+
+func TestDownload_completed(t *testing.T) {
+	d := NewDownload("", "", "", 1, "", 3, false, 0, 3)
+	d.size = 10
+	d.genBatch()
+	d.batchMap[0] = true
+	d.batchMap[1] = true
+	assert.True(t, d.completed(0, 5))
+	assert.True(t, d.completed(4, 4))
+	assert.False(t, d.completed(4, 6))
+}
+
+func TestDownload_ServeHTTPSubRange(t *testing.T) {
+	dst := "/tmp/pget.subrange"
+	f, _ := os.Create(dst)
+	f.WriteString("hello,world")
+	f.Close()
+	defer os.Remove(dst)
+	d := NewDownload("http://localhost/", "http://localhost", dst, 1, "", 3, true, 0, 3)
+	d.size = 11
+	d.genBatch()
+	d.batchMap[1] = true
+	d.batchMap[2] = true
+	d.httpServer()
+	req, _ := http.NewRequest("GET", fmt.Sprintf("http://localhost:%d", d.httpListenPort), nil)
+	req.Header.Set("Range", "bytes=4-7")
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Equal(t, res.StatusCode, 206)
+	assert.Equal(t, res.Header.Get("Content-Range"), "bytes 4-7/11")
+	assert.Equal(t, res.ContentLength, int64(4))
+	assert.Equal(t, string(body), "o,wo")
+}
+
+func TestDownload_ServeHTTPStatus(t *testing.T) {
+	dst := "/tmp/pget.status"
+	f, _ := os.Create(dst)
+	f.WriteString("hello,world")
+	f.Close()
+	defer os.Remove(dst)
+	d := NewDownload("http://localhost/", "http://localhost", dst, 1, "", 3, true, 0, 3)
+	d.size = 11
+	d.genBatch()
+	d.batchMap[0] = true
+	d.batchMap[3] = true
+	d.httpServer()
+	get := func(rangeHeader string) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("http://localhost:%d", d.httpListenPort), nil)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return res, string(body)
+	}
+
+	res, body := get("bytes=-2")
+	assert.Equal(t, res.StatusCode, 206)
+	assert.Equal(t, body, "ld")
+
+	res, _ = get("bytes=20-")
+	assert.Equal(t, res.StatusCode, 416)
+	assert.Equal(t, res.Header.Get("Content-Range"), "bytes */11")
+
+	res, _ = get("bytes=2-4")
+	assert.Equal(t, res.StatusCode, 404)
+
+	res, _ = get("")
+	assert.Equal(t, res.StatusCode, 404)
+
+	res, body = get("bytes=0-1,9-10")
+	assert.Equal(t, res.StatusCode, 206)
+	assert.Contains(t, res.Header.Get("Content-Type"), "multipart/byteranges")
+	assert.Contains(t, body, "Content-Range: bytes 0-1/11")
+	assert.Contains(t, body, "Content-Range: bytes 9-10/11")
+	assert.Contains(t, body, "ld")
+
+	d.batchMap[1] = true
+	d.batchMap[2] = true
+	res, body = get("")
+	assert.Equal(t, res.StatusCode, 200)
+	assert.Equal(t, body, "hello,world")
+
+	// a malformed range is ignored
+	for _, ra := range []string{"bytes=0-ttt", "items=0-1", "bytes=5-3", "bytes=0-,0-,0-"} {
+		res, body = get(ra)
+		assert.Equal(t, res.StatusCode, 200)
+		assert.Equal(t, body, "hello,world")
+	}
 }
 
 func TestDownload_announce(t *testing.T) {
@@ -150,7 +279,7 @@ func TestDownload_ServeHTTP2(t *testing.T) {
 	d.httpServer()
 	res, err := http.Get(fmt.Sprintf("http://localhost:%d", d.httpListenPort))
 	assert.NoError(t, err)
-	assert.Equal(t, res.StatusCode, 500)
+	assert.Equal(t, res.StatusCode, 503)
 }
 
 func TestDownload_downloadBatch(t *testing.T) {
@@ -248,3 +377,51 @@ func TestDownload_SetTrackerRequestHeader(t *testing.T) {
 	assert.Equal(t, d.th.RequestHeader[0], [2]string{"Host", "127.0.0.1"})
 	assert.Equal(t, d.th.RequestHeader[1], [2]string{"User-Agent", "pget"})
 }
+
+func TestDownload_getSizeVersion(t *testing.T) {
+	runTestTrackerServer()
+	f, _ := os.Create("/tmp/source")
+	f.WriteString("hello,world")
+	f.Close()
+	defer os.Remove("/tmp/source")
+	d := NewDownload("http://localhost:33345/source", "", "/tmp/pget", 1, "", 11, false, 0, 3)
+	assert.NoError(t, d.getSize())
+	assert.NotEmpty(t, d.lastModified)
+	assert.Equal(t, d.version(), d.lastModified)
+}
+
+func TestDownload_downloadBatchSourceChanged(t *testing.T) {
+	runTestTrackerServer()
+	f, _ := os.Create("/tmp/source")
+	f.WriteString("hello,world")
+	f.Close()
+	defer os.Remove("/tmp/source")
+	dst := "/tmp/pget"
+	defer os.Remove(dst)
+	d := NewDownload("http://localhost:33345/source", "", dst, 1, "", 11, false, 0, 3)
+	d.getSize()
+	d.genBatch()
+	mtime := time.Now().Add(-time.Hour)
+	os.Chtimes("/tmp/source", mtime, mtime)
+	err := d.downloadBatch(d.sourceURL, 0)
+	assert.Equal(t, err, ErrSourceChanged)
+}
+
+func TestDownload_downloadBatchRangeUnsupported(t *testing.T) {
+	lastModified := "Mon, 19 Oct 2026 07:00:00 GMT"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// ignores the range
+		w.Header().Set("Last-Modified", lastModified)
+		w.Write([]byte("hello,world"))
+	}))
+	defer ts.Close()
+	dst := "/tmp/pget_range_unsupported"
+	defer os.Remove(dst)
+	d := NewDownload(ts.URL, "", dst, 1, "", 4, false, 0, 3)
+	assert.NoError(t, d.getSize())
+	d.genBatch()
+	assert.Equal(t, ErrRangeUnsupported, d.downloadBatch(d.sourceURL, 0))
+
+	lastModified = "Mon, 19 Oct 2026 08:00:00 GMT"
+	assert.Equal(t, ErrSourceChanged, d.downloadBatch(d.sourceURL, 0))
+}
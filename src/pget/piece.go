@@ -0,0 +1,280 @@
+package pget
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+const (
+	// max peers fetching the pieces of a batch at the same time
+	PIECE_CONCURRENT = 4
+	// an in progress piece is split only if this many bytes are left
+	PIECE_MIN_STEAL = 64 * 1024
+)
+
+// segment is a byte range of a batch, next is the first byte not written
+// yet. The fetcher owning it stops at end, which is lowered when an idle
+// fetcher steals the rest.
+type segment struct {
+	next  int64
+	end   int64
+	owned bool
+}
+
+// batchPieces is the progress of a batch fetched in pieces, it's kept
+// across the attempts so a broken conn resumes where it stopped.
+type batchPieces struct {
+	segments []*segment
+}
+
+// SetPieceSize splits the batches in pieces of n bytes which are fetched
+// from several peers in parallel, the batch is still verified and announced
+// as a whole. It has no effect on stream output.
+func (d *download) SetPieceSize(n int64) {
+	d.pieceSize = n
+}
+
+func (d *download) usePieces(batch int64) bool {
+	start, end := d.genRange(batch)
+	return d.pieceSize > 0 && d.pieceSize < end-start+1 && d.stream == nil
+}
+
+// batchPieces returns the progress of batch. Must be called with the lock
+// held.
+func (d *download) batchPieces(batch int64) *batchPieces {
+	if d.pieces == nil {
+		d.pieces = make(map[int64]*batchPieces)
+	}
+	p := d.pieces[batch]
+	if p == nil {
+		p = &batchPieces{}
+		start, end := d.genRange(batch)
+		for off := start; off <= end; off += d.pieceSize {
+			s := &segment{next: off, end: off + d.pieceSize - 1}
+			if s.end > end {
+				s.end = end
+			}
+			p.segments = append(p.segments, s)
+		}
+		d.pieces[batch] = p
+	}
+	return p
+}
+
+func (p *batchPieces) done() bool {
+	for _, s := range p.segments {
+		if s.next <= s.end {
+			return false
+		}
+	}
+	return true
+}
+
+// claim returns a segment left to fetch, or the second half of the in
+// progress segment with the most bytes left.
+func (p *batchPieces) claim() *segment {
+	var slow *segment
+	for _, s := range p.segments {
+		if s.next > s.end {
+			continue
+		}
+		if !s.owned {
+			s.owned = true
+			return s
+		}
+		if slow == nil || s.end-s.next > slow.end-slow.next {
+			slow = s
+		}
+	}
+	if slow == nil || slow.end-slow.next+1 < 2*PIECE_MIN_STEAL {
+		return nil
+	}
+	mid := slow.next + (slow.end-slow.next+1)/2
+	s := &segment{next: mid, end: slow.end, owned: true}
+	slow.end = mid - 1
+	p.segments = append(p.segments, s)
+	return s
+}
+
+// claimable reports whether a fetcher would get a segment.
+func (p *batchPieces) claimable() bool {
+	for _, s := range p.segments {
+		if s.next <= s.end && (!s.owned || s.end-s.next+1 >= 2*PIECE_MIN_STEAL) {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchPieces fetches the pieces left of the batch of a, every peer is used
+// by a fetcher stealing the pieces as it's done with one. It returns nil once
+// the whole batch is written.
+func (d *download) fetchPieces(a *attempt, peers []string) error {
+	if len(peers) > PIECE_CONCURRENT {
+		peers = peers[:PIECE_CONCURRENT]
+	}
+	d.Lock()
+	p := d.batchPieces(a.batch)
+	d.Unlock()
+	for {
+		errs := make(chan error, len(peers))
+		for _, peer := range peers {
+			go func(peer string) {
+				errs <- d.pieceFetcher(a, p, peer)
+			}(peer)
+		}
+		// a failure takes precedence over a busy peer
+		var err error
+		for range peers {
+			e := <-errs
+			if e == nil {
+				continue
+			}
+			if _, busy := err.(*busyError); err == nil || e == ErrSourceChanged || busy {
+				err = e
+			}
+		}
+		d.Lock()
+		// wait for the pieces owned by the other attempts of the batch
+		for err == nil && !p.done() && !p.claimable() && a.ctx.Err() == nil {
+			d.attemptCond.Wait()
+		}
+		done := p.done()
+		d.Unlock()
+		if done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if a.ctx.Err() != nil {
+			return a.ctx.Err()
+		}
+	}
+}
+
+// fetchPiecesAttempt fetches the batch of a in pieces up to DOWNLOAD_RETRY
+// times, a round where every peer is busy doesn't count.
+func (d *download) fetchPiecesAttempt(a *attempt) (err error) {
+	busyRetry := 0
+	for i := 1; i <= DOWNLOAD_RETRY; {
+		begin := time.Now()
+		err = d.fetchPieces(a, d.orderPeers(a, d.getPeers(a.batch)))
+		if err == nil {
+			if !d.complete(a) {
+				return nil
+			}
+			start, end := d.genRange(a.batch)
+			d.logBatch(a.batch, "").WithField("bytes", end-start+1).WithField("duration", time.Since(begin)).Debugf("fetch batch success")
+			d.observeThroughput(end-start+1, time.Since(begin))
+			d.wg.Done()
+			d.announce(a.batch)
+			return nil
+		}
+		if err == ErrSourceChanged || a.ctx.Err() != nil {
+			return err
+		}
+		if busy, ok := err.(*busyError); ok && busyRetry < BUSY_RETRY {
+			busyRetry += 1
+			select {
+			case <-time.After(busy.retryAfter):
+			case <-a.ctx.Done():
+			}
+			continue
+		}
+		i++
+	}
+	return err
+}
+
+// pieceFetcher fetches segments of p from peer until none is left.
+func (d *download) pieceFetcher(a *attempt, p *batchPieces, peer string) error {
+	for {
+		d.Lock()
+		s := p.claim()
+		d.Unlock()
+		if s == nil {
+			return nil
+		}
+		begin := time.Now()
+		err := d.fetchSegment(a.ctx, peer, s)
+		d.Lock()
+		s.owned = false
+		d.attemptCond.Broadcast()
+		d.Unlock()
+		log := d.logBatch(a.batch, peer).WithField("duration", time.Since(begin))
+		if err == nil {
+			d.health.ok(peer)
+			continue
+		}
+		if a.ctx.Err() != nil || err == ErrSourceChanged {
+			return err
+		}
+		if err == errMissingBatch {
+			d.recordRetry(peer, false)
+			log.Debugf("peer doesn't have the piece")
+		} else if busy, ok := err.(*busyError); ok {
+			log.WithField("err", err).Debugf("peer is busy")
+			d.recordRetry(peer, false)
+			d.health.busy(peer, busy.retryAfter)
+		} else {
+			d.health.fail(peer)
+			d.recordRetry(peer, true)
+			log.WithField("err", err).Warningf("fetch piece err")
+		}
+		return err
+	}
+}
+
+// fetchSegment writes the bytes of s fetched from peer, s.next is advanced
+// as they are written and the fetch stops at s.end.
+func (d *download) fetchSegment(ctx context.Context, peer string, s *segment) error {
+	d.Lock()
+	start, end := s.next, s.end
+	d.Unlock()
+	if start > end {
+		return nil
+	}
+	src, closeBody, err := d.requestRange(ctx, peer, start, end)
+	if err != nil {
+		return err
+	}
+	defer closeBody()
+	f, err := d.openDst()
+	if err != nil {
+		d.fatalf("%v", err)
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			d.Lock()
+			pos, end := s.next, s.end
+			d.Unlock()
+			if int64(n) > end-pos+1 {
+				// the rest was stolen
+				n = int(end - pos + 1)
+			}
+			if n > 0 {
+				if _, err := f.WriteAt(buf[:n], pos); err != nil {
+					d.fatalf("%v", err)
+				}
+				d.Lock()
+				s.next = pos + int64(n)
+				d.Unlock()
+				d.recordBatch(peer, int64(n))
+			}
+			if pos+int64(n) > end {
+				return nil
+			}
+		}
+		if err == io.EOF {
+			return errors.New("invalid length")
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package pget
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatchPieces_claim(t *testing.T) {
+	p := &batchPieces{segments: []*segment{
+		{next: 0, end: 4*PIECE_MIN_STEAL - 3},
+		{next: 4 * PIECE_MIN_STEAL, end: 4*PIECE_MIN_STEAL + 9},
+	}}
+	assert.Equal(t, p.segments[0], p.claim())
+	assert.Equal(t, p.segments[1], p.claim())
+	// steal the second half of the largest one
+	s := p.claim()
+	assert.NotNil(t, s)
+	assert.Equal(t, int64(2*PIECE_MIN_STEAL-1), s.next)
+	assert.Equal(t, int64(4*PIECE_MIN_STEAL-3), s.end)
+	assert.Equal(t, int64(2*PIECE_MIN_STEAL-2), p.segments[0].end)
+	// the halves are too small to steal
+	assert.Nil(t, p.claim())
+	assert.False(t, p.claimable())
+	for _, s := range p.segments {
+		s.next = s.end + 1
+	}
+	assert.True(t, p.done())
+}
+
+func TestDownload_StartPieces(t *testing.T) {
+	content := make([]byte, 300000)
+	rand.Read(content)
+	var lock sync.Mutex
+	var ranges []string
+	broken := false
+	modTime := time.Now()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		// break the first piece in the middle
+		breakConn := !broken && r.Header.Get("Range") == "bytes=0-49999"
+		if breakConn {
+			broken = true
+		}
+		lock.Unlock()
+		if breakConn {
+			w.Header().Set("Content-Range", "bytes 0-49999/300000")
+			w.Header().Set("Content-Length", "50000")
+			w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+			w.WriteHeader(206)
+			w.Write(content[:20000])
+			w.(http.Flusher).Flush()
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		http.ServeContent(w, r, "source", modTime, bytes.NewReader(content))
+	}))
+	defer ts.Close()
+	dst := "/tmp/pget_pieces"
+	defer os.Remove(dst)
+	d := NewDownload(ts.URL, "", dst, 2, "", 200000, false, 0, 3)
+	d.SetPieceSize(50000)
+	done := make(chan bool)
+	go func() {
+		d.Start()
+		close(done)
+	}()
+	select {
+	case <-done:
+		buf, _ := ioutil.ReadFile(dst)
+		assert.True(t, bytes.Equal(content, buf))
+	case <-time.After(5 * time.Second):
+		assert.True(t, false)
+		return
+	}
+	// the broken piece resumed where it stopped
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Contains(t, strings.Join(ranges, ","), "bytes=20000-49999")
+	assert.Equal(t, 0, len(d.pieces))
+}
@@ -0,0 +1,18 @@
+package pget
+
+import (
+	"os"
+	"syscall"
+)
+
+// preallocate reserves size bytes for f with fallocate, so the blocks are
+// allocated contiguously where the filesystem can, and falls back to
+// truncate when fallocate isn't supported.
+func preallocate(f *os.File, size int64) error {
+	err := syscall.Fallocate(int(f.Fd()), 0, 0, size)
+	if err == nil {
+		return nil
+	}
+	g.Debugf("fallocate %s err:%v, fallback to truncate", f.Name(), err)
+	return f.Truncate(size)
+}
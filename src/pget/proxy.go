@@ -0,0 +1,193 @@
+package pget
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// a proxy setting to connect directly
+	PROXY_DIRECT = "direct"
+)
+
+type proxyFunc func(*http.Request) (*url.URL, error)
+
+func noProxyFunc(*http.Request) (*url.URL, error) {
+	return nil, nil
+}
+
+// parseProxy returns the proxy func of a proxy setting, empty uses the
+// environment and PROXY_DIRECT none. Hosts matching a noProxy rule are
+// reached directly.
+func parseProxy(proxy string, noProxy []string) (proxyFunc, error) {
+	fn := proxyFunc(http.ProxyFromEnvironment)
+	switch proxy {
+	case "":
+	case PROXY_DIRECT:
+		fn = noProxyFunc
+	default:
+		u, err := url.Parse(proxy)
+		if err != nil || u.Host == "" {
+			return nil, errors.New(fmt.Sprintf("invalid proxy:%s", proxy))
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, errors.New(fmt.Sprintf("unsupported proxy scheme:%s", proxy))
+		}
+		fn = http.ProxyURL(u)
+	}
+	if len(noProxy) == 0 {
+		return fn, nil
+	}
+	return func(req *http.Request) (*url.URL, error) {
+		if matchNoProxy(req.URL, noProxy) {
+			return nil, nil
+		}
+		return fn(req)
+	}, nil
+}
+
+// parseNoProxy splits a NO_PROXY style list.
+func parseNoProxy(s string) (rules []string) {
+	for _, rule := range strings.Split(s, ",") {
+		if rule = strings.ToLower(strings.TrimSpace(rule)); rule != "" {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// matchNoProxy reports whether u matches a NO_PROXY rule: "*", a domain and
+// its subdomains, a host:port, an ip or a cidr.
+func matchNoProxy(u *url.URL, rules []string) bool {
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if port == "" {
+		port = defaultPort(u.Scheme)
+	}
+	ip := net.ParseIP(host)
+	for _, rule := range rules {
+		if rule == "*" {
+			return true
+		}
+		if _, cidr, err := net.ParseCIDR(rule); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		ruleHost := rule
+		if h, p, err := net.SplitHostPort(rule); err == nil {
+			if p != port {
+				continue
+			}
+			ruleHost = h
+		}
+		ruleHost = strings.Trim(ruleHost, "[]")
+		if ruleIP := net.ParseIP(ruleHost); ruleIP != nil {
+			if ip != nil && ruleIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		ruleHost = strings.TrimPrefix(ruleHost, ".")
+		if host == ruleHost || strings.HasSuffix(host, "."+ruleHost) {
+			return true
+		}
+	}
+	return false
+}
+
+func defaultPort(scheme string) string {
+	if scheme == "https" {
+		return "443"
+	}
+	return "80"
+}
+
+// hostPort returns the host:port of a url, with the default port of its
+// scheme if it has none.
+func hostPort(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return ""
+	}
+	port := u.Port()
+	if port == "" {
+		port = defaultPort(u.Scheme)
+	}
+	return net.JoinHostPort(strings.ToLower(u.Hostname()), port)
+}
+
+// parseResolve parses curl style host:port:addr overrides into a map of
+// host:port to the address to dial instead.
+func parseResolve(entries []string) (map[string]string, error) {
+	resolve := make(map[string]string)
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			return nil, errors.New(fmt.Sprintf("invalid resolve:%s, should be host:port:addr", entry))
+		}
+		addr := strings.Trim(parts[2], "[]")
+		if net.ParseIP(addr) == nil {
+			return nil, errors.New(fmt.Sprintf("invalid resolve:%s, addr should be an ip", entry))
+		}
+		resolve[net.JoinHostPort(strings.ToLower(parts[0]), parts[1])] = net.JoinHostPort(addr, parts[1])
+	}
+	return resolve, nil
+}
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// resolveDial dials the address of resolve instead of addr when there's one.
+func resolveDial(dial dialFunc, resolve map[string]string) dialFunc {
+	if len(resolve) == 0 {
+		return dial
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if to, ok := resolve[strings.ToLower(addr)]; ok {
+			addr = to
+		}
+		return dial(ctx, network, addr)
+	}
+}
+
+// proxy returns the proxy func of the requests of the download, the origin,
+// the tracker and the peers can have their own proxy.
+func (d *download) proxy(opts TransportOptions) (proxyFunc, error) {
+	noProxy := parseNoProxy(opts.NoProxy)
+	proxies := make(map[string]proxyFunc)
+	for class, proxy := range map[string]string{
+		"origin":  opts.OriginProxy,
+		"tracker": opts.TrackerProxy,
+		"peer":    opts.PeerProxy,
+	} {
+		if proxy == "" {
+			proxy = opts.Proxy
+		}
+		fn, err := parseProxy(proxy, noProxy)
+		if err != nil {
+			return nil, err
+		}
+		proxies[class] = fn
+	}
+	origin, tracker := hostPort(d.sourceURL), ""
+	if d.trackerURL != "" {
+		tracker = hostPort(d.trackerURL)
+	}
+	return func(req *http.Request) (*url.URL, error) {
+		switch hostPort(req.URL.String()) {
+		case origin:
+			return proxies["origin"](req)
+		case tracker:
+			return proxies["tracker"](req)
+		}
+		return proxies["peer"](req)
+	}, nil
+}
@@ -0,0 +1,92 @@
+package pget
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchNoProxy(t *testing.T) {
+	rules := parseNoProxy(" example.com, .internal ,10.0.0.0/8, 192.168.1.1, peer.lan:8080 ")
+	for rawurl, match := range map[string]bool{
+		"http://example.com/a":       true,
+		"http://cdn.example.com/a":   true,
+		"http://badexample.com/a":    false,
+		"http://a.internal/":         true,
+		"http://10.1.2.3:12345/":     true,
+		"http://11.1.2.3/":           false,
+		"http://192.168.1.1/":        true,
+		"http://peer.lan:8080/":      true,
+		"http://peer.lan:8081/":      false,
+		"https://origin.com/source":  false,
+		"http://[::1]:8080/anything": false,
+	} {
+		u, _ := url.Parse(rawurl)
+		assert.Equal(t, match, matchNoProxy(u, rules), rawurl)
+	}
+	u, _ := url.Parse("http://any.com/")
+	assert.True(t, matchNoProxy(u, []string{"*"}))
+}
+
+func TestParseResolve(t *testing.T) {
+	resolve, err := parseResolve([]string{"Origin.com:443:10.0.0.1", "v6.com:80:[::1]"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"origin.com:443": "10.0.0.1:443", "v6.com:80": "[::1]:80"}, resolve)
+	_, err = parseResolve([]string{"origin.com:443"})
+	assert.NotNil(t, err)
+	_, err = parseResolve([]string{"origin.com:443:host"})
+	assert.NotNil(t, err)
+}
+
+func TestDownload_proxy(t *testing.T) {
+	d := NewDownload("http://origin.com/source", "http://tracker.com:8080", "", 1, "", 1, true, 0, 3)
+	_, err := d.proxy(TransportOptions{OriginProxy: "ftp://proxy"})
+	assert.NotNil(t, err)
+	proxy, err := d.proxy(TransportOptions{
+		Proxy:        "http://proxy:3128",
+		OriginProxy:  "socks5://socks:1080",
+		TrackerProxy: PROXY_DIRECT,
+		NoProxy:      "10.0.0.0/8",
+	})
+	assert.Nil(t, err)
+	for rawurl, want := range map[string]string{
+		"http://origin.com/source":     "socks5://socks:1080",
+		"http://origin.com:80/source":  "socks5://socks:1080",
+		"http://tracker.com:8080/":     "",
+		"http://peer.com:12345/":       "http://proxy:3128",
+		"http://10.0.0.2:12345/source": "",
+	} {
+		req, _ := http.NewRequest("GET", rawurl, nil)
+		u, err := proxy(req)
+		assert.Nil(t, err)
+		if want == "" {
+			assert.Nil(t, u, rawurl)
+		} else {
+			assert.Equal(t, want, u.String(), rawurl)
+		}
+	}
+}
+
+func TestDownload_StartResolve(t *testing.T) {
+	modTime := time.Now()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "source", modTime, bytes.NewReader([]byte("hello,world")))
+	}))
+	defer ts.Close()
+	port := ts.URL[strings.LastIndex(ts.URL, ":")+1:]
+	dst := "/tmp/pget_resolve"
+	defer os.Remove(dst)
+	d := NewDownload("http://origin.invalid:"+port+"/source", "", dst, 2, "", 4, false, 0, 3)
+	assert.Nil(t, d.SetTransportOptions(TransportOptions{Proxy: PROXY_DIRECT, Resolve: []string{"origin.invalid:" + port + ":127.0.0.1"}}))
+	d.Start()
+	buf, _ := ioutil.ReadFile(dst)
+	assert.Equal(t, "hello,world", string(buf))
+}
@@ -0,0 +1,263 @@
+package pget
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+const (
+	READER_READAHEAD = 2
+)
+
+// Reader gives random access to a download, batches are fetched on demand
+// with the requested ones first, so the whole file isn't needed to read a
+// part of it. Completed batches are kept in the dst file, which acts as a
+// cache and is seeded to peers like a normal download.
+type Reader struct {
+	d         *download
+	f         *os.File
+	offset    int64
+	readahead int64
+	// batches waiting for a worker, requested batches are at the front
+	queue  []int64
+	queued map[int64]bool
+	errs   map[int64]error
+	cond   *sync.Cond
+	closed bool
+	// the workers, Close waits for them before closing the file
+	workers sync.WaitGroup
+}
+
+// Reader starts fetching the download on demand, d.dst is used as the cache
+// file of the completed batches.
+func (d *download) Reader() (*Reader, error) {
+	if d.dst == "" {
+		return nil, errors.New("reader needs a dst file as cache")
+	}
+	if d.stream != nil {
+		return nil, errors.New("reader can't be used with stream output")
+	}
+	if err := d.getSize(); err != nil {
+		return nil, err
+	}
+	if err := d.prepareDst(); err != nil {
+		return nil, err
+	}
+	f, err := d.openDst()
+	if err != nil {
+		return nil, err
+	}
+	d.genBatch()
+	if d.serving() {
+		d.httpServer()
+		go d.pexLoop()
+		d.startDiscovery()
+	}
+	r := &Reader{
+		d:         d,
+		f:         f,
+		readahead: READER_READAHEAD,
+		queued:    make(map[int64]bool),
+		errs:      make(map[int64]error),
+		cond:      sync.NewCond(&d.Mutex),
+	}
+	batchChan := make(chan int64)
+	for i := 1; i <= d.concurrent; i++ {
+		r.workers.Add(1)
+		go r.worker(batchChan)
+	}
+	go r.schedule(batchChan)
+	return r, nil
+}
+
+// SetReadahead sets how many batches after a read are fetched in advance.
+func (r *Reader) SetReadahead(n int64) {
+	r.d.Lock()
+	r.readahead = n
+	r.d.Unlock()
+}
+
+// Size returns the size of the file.
+func (r *Reader) Size() int64 {
+	return r.d.size
+}
+
+// schedule hands queued batches to the workers, the choice is made as late
+// as possible so that batches requested meanwhile go first.
+func (r *Reader) schedule(b chan int64) {
+	defer close(b)
+	for {
+		r.d.Lock()
+		for len(r.queue) == 0 && !r.closed {
+			r.cond.Wait()
+		}
+		if r.closed {
+			r.d.Unlock()
+			return
+		}
+		batch := r.queue[0]
+		r.queue = r.queue[1:]
+		r.d.Unlock()
+		b <- batch
+	}
+}
+
+func (r *Reader) worker(b chan int64) {
+	defer r.workers.Done()
+	for batch := range b {
+		r.d.Lock()
+		if r.closed {
+			r.d.Unlock()
+			continue
+		}
+		// begun under the lock so that Close cancels it
+		a := r.d.beginAttempt(batch, false)
+		r.d.Unlock()
+		err := r.d.fetchAttempt(a)
+		r.d.Lock()
+		delete(r.queued, batch)
+		if err != nil {
+			r.errs[batch] = err
+		} else {
+			// an error of an earlier attempt is stale
+			delete(r.errs, batch)
+		}
+		r.cond.Broadcast()
+		r.d.Unlock()
+	}
+}
+
+// request queues the batches which are neither completed nor being fetched,
+// in front of the queue if urgent. Must be called with the lock held.
+func (r *Reader) request(first int64, last int64, urgent bool) {
+	var batches []int64
+	for batch := first; batch <= last && batch*r.d.batchSize < r.d.size; batch++ {
+		if r.d.batchMap[batch] {
+			continue
+		}
+		if r.queued[batch] {
+			if !urgent {
+				continue
+			}
+			// move it to the front unless a worker already has it
+			found := false
+			for i, b := range r.queue {
+				if b == batch {
+					r.queue = append(r.queue[:i], r.queue[i+1:]...)
+					found = true
+					break
+				}
+			}
+			if !found {
+				continue
+			}
+		}
+		r.queued[batch] = true
+		batches = append(batches, batch)
+	}
+	if urgent {
+		r.queue = append(batches, r.queue...)
+	} else {
+		r.queue = append(r.queue, batches...)
+	}
+	r.cond.Broadcast()
+}
+
+// ReadAt implements io.ReaderAt, it blocks until the batches covering the
+// range are downloaded.
+func (r *Reader) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= r.d.size {
+		return 0, io.EOF
+	}
+	end := off + int64(len(p))
+	if end > r.d.size {
+		end = r.d.size
+	}
+	if end == off {
+		return 0, nil
+	}
+	first, last := off/r.d.batchSize, (end-1)/r.d.batchSize
+
+	r.d.Lock()
+	r.request(first, last, true)
+	r.request(last+1, last+r.readahead, false)
+	for batch := first; batch <= last; batch++ {
+		for !r.d.batchMap[batch] && r.errs[batch] == nil && !r.closed {
+			r.cond.Wait()
+		}
+		if r.closed {
+			r.d.Unlock()
+			return 0, errors.New("reader is closed")
+		}
+		if r.d.batchMap[batch] {
+			continue
+		}
+		if err = r.errs[batch]; err != nil {
+			// let the next read try again
+			delete(r.errs, batch)
+			r.d.Unlock()
+			return 0, err
+		}
+	}
+	r.d.Unlock()
+
+	n, err = r.f.ReadAt(p[:end-off], off)
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Read implements io.Reader.
+func (r *Reader) Read(p []byte) (n int, err error) {
+	n, err = r.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	return n, err
+}
+
+// Seek implements io.Seeker.
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.d.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+// Close stops fetching batches and the upload server, the cache file is
+// kept.
+func (r *Reader) Close() error {
+	r.d.Lock()
+	if r.closed {
+		r.d.Unlock()
+		return nil
+	}
+	r.closed = true
+	r.cond.Broadcast()
+	// stop the fetches in flight
+	for _, attempts := range r.d.inflight {
+		for a := range attempts {
+			a.cancel()
+		}
+	}
+	r.d.Unlock()
+	r.d.Stop()
+	// a worker would open the file again
+	r.workers.Wait()
+	r.d.closeDst()
+	return nil
+}
@@ -0,0 +1,113 @@
+package pget
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownload_Reader(t *testing.T) {
+	runTestTrackerServer()
+	f, _ := os.Create("/tmp/source")
+	f.WriteString("hello,world")
+	f.Close()
+	defer os.Remove("/tmp/source")
+	dst := "/tmp/pget.cache"
+	defer os.Remove(dst)
+	d := NewDownload("http://localhost:33345/source", "", dst, 2, "", 2, false, 0, 3)
+	r, err := d.Reader()
+	assert.NoError(t, err)
+	defer r.Close()
+	r.SetReadahead(0)
+	assert.Equal(t, r.Size(), int64(11))
+
+	buf := make([]byte, 3)
+	n, err := r.ReadAt(buf, 6)
+	assert.NoError(t, err)
+	assert.Equal(t, n, 3)
+	assert.Equal(t, string(buf), "wor")
+	// only the batches covering the range are fetched
+	d.Lock()
+	assert.True(t, d.batchMap[3])
+	assert.True(t, d.batchMap[4])
+	assert.False(t, d.batchMap[0])
+	// an error of a failed readahead of a batch completed since
+	r.errs[3] = errors.New("stale")
+	d.Unlock()
+	n, err = r.ReadAt(buf, 6)
+	assert.NoError(t, err)
+	assert.Equal(t, string(buf), "wor")
+
+	n, err = r.ReadAt(buf, 9)
+	assert.Equal(t, err, io.EOF)
+	assert.Equal(t, n, 2)
+	assert.Equal(t, string(buf[:n]), "ld")
+
+	pos, err := r.Seek(0, io.SeekStart)
+	assert.NoError(t, err)
+	assert.Equal(t, pos, int64(0))
+	all, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, string(all), "hello,world")
+}
+
+func TestDownload_ReaderWithoutDst(t *testing.T) {
+	d := NewDownload("http://localhost:33345/source", "", "", 2, "", 2, false, 0, 3)
+	_, err := d.Reader()
+	assert.Error(t, err)
+}
+
+func TestDownload_ReaderCloseInFlight(t *testing.T) {
+	started := make(chan bool, 10)
+	release := make(chan bool)
+	defer close(release)
+	modTime := time.Now()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			started <- true
+			select {
+			case <-release:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		http.ServeContent(w, r, "source", modTime, strings.NewReader("hello,world"))
+	}))
+	defer ts.Close()
+	dst := "/tmp/pget_reader_close"
+	defer os.Remove(dst)
+	d := NewDownload(ts.URL, "", dst, 2, "", 2, false, 0, 3)
+	r, err := d.Reader()
+	assert.NoError(t, err)
+	read := make(chan error)
+	go func() {
+		_, err := r.ReadAt(make([]byte, 3), 0)
+		read <- err
+	}()
+	<-started
+	closed := make(chan bool)
+	go func() {
+		r.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		assert.True(t, false)
+		return
+	}
+	assert.Error(t, <-read)
+	// the workers are done, none opened the file again
+	d.Lock()
+	assert.Nil(t, d.file)
+	assert.Len(t, d.inflight, 0)
+	d.Unlock()
+}
@@ -0,0 +1,148 @@
+package pget
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"time"
+)
+
+const (
+	CHECKSUM_PASS = "pass"
+	CHECKSUM_FAIL = "fail"
+	CHECKSUM_SKIP = "skip"
+)
+
+// Report is the summary of a download, written as json when it ends.
+type Report struct {
+	Source    string `json:"source"`
+	Dst       string `json:"dst"`
+	Success   bool   `json:"success"`
+	Error     string `json:"error,omitempty"`
+	Size      int64  `json:"size"`
+	BatchSize int64  `json:"batch_size"`
+	// seconds from the start to the end of the download, seeding excluded
+	Duration float64 `json:"duration"`
+	// bytes per second
+	Throughput  float64 `json:"throughput"`
+	OriginBytes int64   `json:"origin_bytes"`
+	PeerBytes   int64   `json:"peer_bytes"`
+	// bytes downloaded from every peer, the origin included
+	Bytes       map[string]int64 `json:"bytes"`
+	Retries     int              `json:"retries"`
+	FailedPeers []string         `json:"failed_peers"`
+	Checksum    string           `json:"checksum"`
+	Upload      uploadMetrics    `json:"upload"`
+}
+
+// downloadStats are collected for the report.
+type downloadStats struct {
+	begin    time.Time
+	end      time.Time
+	bytes    map[string]int64
+	retries  int
+	failed   map[string]bool
+	checksum string
+}
+
+// SetReport makes Start write a Report to file when the download ends,
+// successful or not.
+func (d *download) SetReport(file string) {
+	d.report = file
+}
+
+// recordBatch counts the bytes of a batch fetched from peer.
+func (d *download) recordBatch(peer string, n int64) {
+	d.Lock()
+	defer d.Unlock()
+	if d.stats.bytes == nil {
+		d.stats.bytes = make(map[string]int64)
+	}
+	d.stats.bytes[peer] += n
+	d.recordThroughput(n, false)
+}
+
+// recordRetry counts a failed fetch, a busy peer isn't a failed one.
+func (d *download) recordRetry(peer string, failed bool) {
+	d.Lock()
+	defer d.Unlock()
+	d.stats.retries += 1
+	if failed {
+		if d.stats.failed == nil {
+			d.stats.failed = make(map[string]bool)
+		}
+		d.stats.failed[peer] = true
+		d.recordThroughput(0, true)
+	}
+}
+
+func (d *download) setChecksum(result string) {
+	d.Lock()
+	d.stats.checksum = result
+	d.Unlock()
+}
+
+// Report returns the summary of the download so far, err is the reason it
+// failed if any.
+func (d *download) Report(err error) *Report {
+	d.Lock()
+	defer d.Unlock()
+	r := &Report{
+		Source:      d.sourceURL,
+		Dst:         d.dst,
+		Success:     err == nil,
+		Size:        d.size,
+		BatchSize:   d.batchSize,
+		Bytes:       make(map[string]int64),
+		Retries:     d.stats.retries,
+		FailedPeers: []string{},
+		Checksum:    d.stats.checksum,
+		Upload:      d.uploadSlots.snapshot(),
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	if r.Checksum == "" {
+		r.Checksum = CHECKSUM_SKIP
+	}
+	for peer, n := range d.stats.bytes {
+		r.Bytes[peer] = n
+		if peer == d.sourceURL {
+			r.OriginBytes += n
+		} else {
+			r.PeerBytes += n
+		}
+	}
+	for peer := range d.stats.failed {
+		r.FailedPeers = append(r.FailedPeers, peer)
+	}
+	sort.Strings(r.FailedPeers)
+	if !d.stats.begin.IsZero() {
+		end := d.stats.end
+		if end.IsZero() {
+			end = time.Now()
+		}
+		r.Duration = end.Sub(d.stats.begin).Seconds()
+		if r.Duration > 0 {
+			r.Throughput = float64(r.OriginBytes+r.PeerBytes) / r.Duration
+		}
+	}
+	return r
+}
+
+// writeReport writes the report once if a report file is set, a later
+// failure doesn't overwrite the first result.
+func (d *download) writeReport(err error) {
+	if d.report == "" {
+		return
+	}
+	d.reportOnce.Do(func() {
+		content, e := json.MarshalIndent(d.Report(err), "", "  ")
+		if e == nil {
+			e = ioutil.WriteFile(d.report, append(content, '\n'), 0644)
+		}
+		if e != nil {
+			g.Warningf("write report %s err:%v", d.report, e)
+		}
+	})
+}
@@ -0,0 +1,108 @@
+package pget
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownload_StartReport(t *testing.T) {
+	runTestTrackerServer()
+	f, _ := os.Create("/tmp/report_source")
+	f.WriteString("hello,world")
+	f.Close()
+	defer os.Remove("/tmp/report_source")
+	dst := "/tmp/pget_report"
+	report := "/tmp/pget_report.json"
+	defer os.Remove(dst)
+	defer os.Remove(report)
+	source := "http://localhost:33345/report_source"
+	d := NewDownload(source, "", dst, 2, "3cb95cfbe1035bce8c448fcaf80fe7d9", 3, false, 0, 3)
+	d.SetReport(report)
+	done := make(chan bool)
+	go func() {
+		d.Start()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(1e9):
+		assert.True(t, false)
+		return
+	}
+	content, err := ioutil.ReadFile(report)
+	assert.Nil(t, err)
+	var r Report
+	assert.Nil(t, json.Unmarshal(content, &r))
+	assert.True(t, r.Success)
+	assert.Equal(t, int64(11), r.Size)
+	assert.Equal(t, int64(3), r.BatchSize)
+	assert.Equal(t, int64(11), r.OriginBytes)
+	assert.Equal(t, int64(0), r.PeerBytes)
+	assert.Equal(t, map[string]int64{source: 11}, r.Bytes)
+	assert.Equal(t, CHECKSUM_PASS, r.Checksum)
+	assert.Equal(t, 0, r.Retries)
+	assert.Equal(t, []string{}, r.FailedPeers)
+	assert.True(t, r.Duration > 0)
+	assert.True(t, r.Throughput > 0)
+}
+
+func TestDownload_AbortSeeding(t *testing.T) {
+	runTestTrackerServer()
+	f, _ := os.Create("/tmp/report_seed_source")
+	f.WriteString("hello,world")
+	f.Close()
+	defer os.Remove("/tmp/report_seed_source")
+	dst := "/tmp/pget_report_seed"
+	report := "/tmp/pget_report_seed.json"
+	defer os.Remove(dst)
+	defer os.Remove(report)
+	d := NewDownload("http://localhost:33345/report_seed_source", "http://localhost:22345", dst, 2, "", 3, true, 3600, 3)
+	d.SetReport(report)
+	done := make(chan bool)
+	go func() {
+		d.Start()
+		close(done)
+	}()
+	for i := 0; i < 100 && d.Status().State != STATE_SEEDING; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, STATE_SEEDING, d.Status().State)
+	d.Abort("test")
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		assert.True(t, false)
+		return
+	}
+	content, err := ioutil.ReadFile(report)
+	assert.Nil(t, err)
+	var r Report
+	assert.Nil(t, json.Unmarshal(content, &r))
+	assert.True(t, r.Success)
+	assert.Equal(t, "", r.Error)
+	buf, _ := ioutil.ReadFile(dst)
+	assert.Equal(t, "hello,world", string(buf))
+}
+
+func TestDownload_Report(t *testing.T) {
+	d := NewDownload("http://localhost/", "", "", 1, "", 3, false, 0, 3)
+	d.recordBatch("http://localhost/", 3)
+	d.recordBatch("http://peer/", 2)
+	d.recordRetry("http://busy/", false)
+	d.recordRetry("http://bad/", true)
+	d.recordRetry("http://bad/", true)
+	r := d.Report(errors.New("oops"))
+	assert.False(t, r.Success)
+	assert.Equal(t, "oops", r.Error)
+	assert.Equal(t, int64(3), r.OriginBytes)
+	assert.Equal(t, int64(2), r.PeerBytes)
+	assert.Equal(t, 3, r.Retries)
+	assert.Equal(t, []string{"http://bad/"}, r.FailedPeers)
+	assert.Equal(t, CHECKSUM_SKIP, r.Checksum)
+}
@@ -0,0 +1,103 @@
+package pget
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	SEED_HEARTBEAT = 300
+)
+
+// Stop closes the upload server, Start and Seed return once the uploads in
+// progress are done.
+func (d *download) Stop() {
+	d.closeOnce.Do(func() {
+		close(d.closeServer)
+	})
+}
+
+// SetHeartbeat sets how often Seed announces all the batches again, so that
+// the tracker doesn't expire them.
+func (d *download) SetHeartbeat(t time.Duration) {
+	d.heartbeat = t
+}
+
+// Seed serves dst, a complete local copy of the source, to the peers until
+// Stop is called. The file is checked against the md5 and the size of the
+// source, and its batches are announced to the tracker periodically.
+func (d *download) Seed() error {
+	if !d.serving() {
+		return errors.New("seed needs a tracker or discovery and upload enabled")
+	}
+	info, err := os.Stat(d.dst)
+	if err != nil {
+		return err
+	}
+	if err := d.getSize(); err != nil {
+		// the version is unknown, peers with a version won't find us
+		g.Warningf("get size of %s err:%v, seed %s without version", d.sourceURL, err, d.dst)
+		d.size = info.Size()
+	} else if d.size != info.Size() {
+		return errors.New(fmt.Sprintf("size of %s is %d, but source size is %d", d.dst, info.Size(), d.size))
+	}
+	if d.md5 != "" {
+		md5, err := MD5sum(d.dst)
+		if err != nil {
+			return err
+		}
+		if strings.ToLower(md5) != strings.ToLower(d.md5) {
+			return errors.New(fmt.Sprintf("md5 verify %s fail", d.dst))
+		}
+		g.Infof("md5 verify %s pass", d.dst)
+	}
+	f, err := os.Open(d.dst)
+	if err != nil {
+		return err
+	}
+	d.Lock()
+	d.file = f
+	d.Unlock()
+	defer d.closeDst()
+
+	d.genBatch()
+	d.Lock()
+	for batch := range d.batchMap {
+		d.batchMap[batch] = true
+	}
+	d.seeding = true
+	d.Unlock()
+	d.httpServer()
+	go d.pexLoop()
+	d.startDiscovery()
+	g.Infof("seed %s as %s", d.dst, d.sourceURL)
+
+	heartbeat := d.heartbeat
+	if heartbeat <= 0 {
+		heartbeat = SEED_HEARTBEAT * time.Second
+	}
+	ticker := time.NewTicker(heartbeat)
+	defer ticker.Stop()
+	for {
+		d.announceAll()
+		select {
+		case <-ticker.C:
+		case <-d.closeServer:
+			g.Infof("stop seeding %s", d.dst)
+			d.httpWg.Wait()
+			return nil
+		}
+	}
+}
+
+func (d *download) announceAll() {
+	d.Lock()
+	n := int64(len(d.batchMap))
+	d.Unlock()
+	for batch := int64(0); batch < n; batch++ {
+		d.announce(batch)
+	}
+}
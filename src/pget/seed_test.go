@@ -0,0 +1,57 @@
+package pget
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+	"tracker"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownload_Seed(t *testing.T) {
+	runTestTrackerServer()
+	f, _ := os.Create("/tmp/source")
+	f.WriteString("hello,world")
+	f.Close()
+	defer os.Remove("/tmp/source")
+	sourceURL := "http://localhost:33345/source"
+	d := NewDownload(sourceURL, "http://localhost:22345", "/tmp/source", 1, "3cb95cfbe1035bce8c448fcaf80fe7d9", 5, true, 0, 3)
+	d.SetHeartbeat(time.Millisecond * 10)
+	done := make(chan error)
+	go func() {
+		done <- d.Seed()
+	}()
+	time.Sleep(time.Millisecond * 100)
+
+	v := NewDownload(sourceURL, "", "", 1, "", 5, false, 0, 3)
+	v.getSize()
+	th := tracker.TrackerHelper{SourceURL: sourceURL, TrackerURL: "http://localhost:22345", Version: v.version()}
+	peers, err := th.GetPeer(2, 5)
+	assert.NoError(t, err)
+	assert.Len(t, peers, 1)
+	assert.Contains(t, peers[0], "http://127.0.0.1:")
+
+	req, _ := http.NewRequest("GET", peers[0], nil)
+	req.Header.Set("Range", "bytes=6-")
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, string(body), "world")
+
+	d.Stop()
+	assert.NoError(t, <-done)
+}
+
+func TestDownload_SeedMD5Fail(t *testing.T) {
+	runTestTrackerServer()
+	f, _ := os.Create("/tmp/source")
+	f.WriteString("hello,world")
+	f.Close()
+	defer os.Remove("/tmp/source")
+	d := NewDownload("http://localhost:33345/source", "http://localhost:22345", "/tmp/source", 1, "00", 5, true, 0, 3)
+	assert.Error(t, d.Seed())
+}
@@ -0,0 +1,316 @@
+package pget
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"logger"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	UPLOAD_RETRY_AFTER = 1
+	// max ranges of a Range header
+	MAX_RANGES = 64
+)
+
+// errNoOverlap means none of the ranges of a Range header is satisfiable.
+var errNoOverlap = errors.New("invalid range: failed to overlap")
+
+// tcpKeepAliveListener sets TCP keep-alive timeouts on accepted
+// connections. It's used by ListenAndServe and ListenAndServeTLS so
+// dead TCP connections (e.g. closing laptop mid-download) eventually
+// go away.
+type tcpKeepAliveListener struct {
+	*net.TCPListener
+}
+
+func (ln tcpKeepAliveListener) Accept() (c net.Conn, err error) {
+	tc, err := ln.AcceptTCP()
+	if err != nil {
+		return
+	}
+	tc.SetKeepAlive(true)
+	tc.SetKeepAlivePeriod(3 * time.Minute)
+	return tc, nil
+}
+
+// httpRange is a satisfiable byte range of the file.
+type httpRange struct {
+	start, length int64
+}
+
+func (r httpRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// parseRange parses a Range header as described by RFC 7233: a list of
+// "start-end", "start-" or "-suffix" byte ranges. Ranges starting after the
+// end of the file are dropped, errNoOverlap is returned if none is left.
+func (d *download) parseRange(rangeHeader string) ([]httpRange, error) {
+	const b = "bytes="
+	if !strings.HasPrefix(rangeHeader, b) {
+		return nil, errors.New(fmt.Sprintf("invalid range header:%s", rangeHeader))
+	}
+	var ranges []httpRange
+	noOverlap := false
+	for _, ra := range strings.Split(rangeHeader[len(b):], ",") {
+		ra = strings.TrimSpace(ra)
+		if ra == "" {
+			continue
+		}
+		i := strings.Index(ra, "-")
+		if i < 0 {
+			return nil, errors.New(fmt.Sprintf("invalid range:%s", ra))
+		}
+		start, end := strings.TrimSpace(ra[:i]), strings.TrimSpace(ra[i+1:])
+		var r httpRange
+		if start == "" {
+			// suffix range, the last end bytes
+			n, err := strconv.ParseInt(end, 10, 64)
+			if err != nil || n < 0 {
+				return nil, errors.New(fmt.Sprintf("invalid range:%s", ra))
+			}
+			if n == 0 {
+				noOverlap = true
+				continue
+			}
+			if n > d.size {
+				n = d.size
+			}
+			r.start = d.size - n
+			r.length = n
+		} else {
+			i, err := strconv.ParseInt(start, 10, 64)
+			if err != nil || i < 0 {
+				return nil, errors.New(fmt.Sprintf("invalid range:%s", ra))
+			}
+			if i >= d.size {
+				noOverlap = true
+				continue
+			}
+			r.start = i
+			if end == "" {
+				r.length = d.size - r.start
+			} else {
+				i, err := strconv.ParseInt(end, 10, 64)
+				if err != nil || r.start > i {
+					return nil, errors.New(fmt.Sprintf("invalid range:%s", ra))
+				}
+				if i >= d.size {
+					i = d.size - 1
+				}
+				r.length = i - r.start + 1
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	if noOverlap && len(ranges) == 0 {
+		return nil, errNoOverlap
+	}
+	if len(ranges) == 0 {
+		return nil, errors.New(fmt.Sprintf("invalid range header:%s", rangeHeader))
+	}
+	// like http.ServeContent, the ranges can't send more than the file
+	var sum int64
+	for _, ra := range ranges {
+		sum += ra.length
+	}
+	if sum > d.size || len(ranges) > MAX_RANGES {
+		return nil, errors.New(fmt.Sprintf("too many or overlapping ranges:%s", rangeHeader))
+	}
+	return ranges, nil
+}
+
+// completed reports whether all the batches covering start-end are
+// completed.
+func (d *download) completed(start int64, end int64) bool {
+	d.Lock()
+	defer d.Unlock()
+	for batch := start / d.batchSize; batch <= end/d.batchSize; batch++ {
+		if !d.batchMap[batch] {
+			return false
+		}
+	}
+	return true
+}
+
+// checkIfRange reports whether the Range header should be used, If-Range
+// must match the version of the file.
+func (d *download) checkIfRange(r *http.Request) bool {
+	ir := r.Header.Get("If-Range")
+	if ir == "" {
+		return true
+	}
+	if strings.HasPrefix(ir, `"`) || strings.HasPrefix(ir, "W/") {
+		return d.etag != "" && !strings.HasPrefix(ir, "W/") && ir == d.etag
+	}
+	return d.lastModified != "" && ir == d.lastModified
+}
+
+// remoteHost returns the ip of the client.
+func remoteHost(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+func (d *download) httpServer() {
+
+	srv := &http.Server{Addr: ":0", Handler: d}
+
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		d.fatalf("%v", err)
+	}
+	d.httpListenPort = ln.Addr().(*net.TCPAddr).Port
+	g.Infof("listen at :%d", d.httpListenPort)
+	go srv.Serve(tcpKeepAliveListener{ln.(*net.TCPListener)})
+}
+
+func (d *download) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	select {
+	case <-d.closeServer:
+		g.Info("receive close singal, will return")
+		w.WriteHeader(503)
+		w.Write([]byte("close connection"))
+		return
+	default:
+	}
+
+	if r.URL.Path == METRICS_PATH {
+		d.uploadSlots.serveMetrics(w)
+		return
+	}
+	if r.URL.Path == PEX_PATH {
+		d.servePex(w, r)
+		return
+	}
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		w.WriteHeader(405)
+		w.Write([]byte("invalid method"))
+		return
+	}
+
+	client := remoteHost(r)
+	log := logger.WithFields(logger.Fields{"source": d.sourceURL, "peer": client})
+	if !d.uploadSlots.acquire(client, d.closeServer) {
+		log.Warningf("upload conn is greater than upload concurrent:%d", d.uploadSlots.concurrent)
+		w.Header().Set("Retry-After", strconv.Itoa(UPLOAD_RETRY_AFTER))
+		w.WriteHeader(503)
+		w.Write([]byte("upload conn is full"))
+		return
+	}
+
+	d.httpWg.Add(1)
+	defer func() {
+		d.httpWg.Done()
+		d.uploadSlots.release(client)
+	}()
+
+	d.Lock()
+	started := d.batchMap != nil
+	d.Unlock()
+	if !started {
+		w.WriteHeader(503)
+		w.Write([]byte("download is not started"))
+		return
+	}
+
+	w.Header().Set("Accept-Ranges", "bytes")
+	if d.etag != "" {
+		w.Header().Set("Etag", d.etag)
+	}
+	if d.lastModified != "" {
+		w.Header().Set("Last-Modified", d.lastModified)
+	}
+
+	ranges := []httpRange{{start: 0, length: d.size}}
+	status := 200
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" && d.checkIfRange(r) {
+		parsed, err := d.parseRange(rangeHeader)
+		if err == errNoOverlap {
+			log.WithField("err", err).Warningf("unsatisfiable range")
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", d.size))
+			w.WriteHeader(416)
+			w.Write([]byte("invalid range"))
+			return
+		} else if err != nil {
+			// an invalid range is ignored, the whole file is sent
+			log.WithField("err", err).Warningf("ignore invalid range")
+		} else {
+			ranges = parsed
+			status = 206
+		}
+	}
+	for _, ra := range ranges {
+		if ra.length > 0 && !d.completed(ra.start, ra.start+ra.length-1) {
+			log.WithField("range", ra.contentRange(d.size)).Warningf("range is not completed")
+			w.WriteHeader(404)
+			w.Write([]byte("batch is not completed"))
+			return
+		}
+	}
+	f, err := d.openDst()
+	if err != nil {
+		g.Error(err)
+		w.WriteHeader(500)
+		w.Write([]byte("error"))
+		return
+	}
+
+	dst := d.uploadSlots.writer(w, d.uploadRateLimit)
+	if len(ranges) == 1 {
+		ra := ranges[0]
+		w.Header().Set("Content-type", "application/octet-stream")
+		if status == 206 {
+			w.Header().Set("Content-Range", ra.contentRange(d.size))
+		}
+		w.Header().Set("Content-Length", strconv.FormatInt(ra.length, 10))
+		w.WriteHeader(status)
+		if r.Method == "HEAD" {
+			return
+		}
+		begin := time.Now()
+		n, err := io.CopyN(dst, io.NewSectionReader(f, ra.start, ra.length), ra.length)
+		log = log.WithField("range", ra.contentRange(d.size)).WithField("bytes", n).WithField("duration", time.Since(begin))
+		if err != nil {
+			// the header is sent, the client sees a short body
+			log.WithField("err", err).Warningf("upload range err")
+		} else {
+			log.Debugf("upload range success")
+		}
+		return
+	}
+
+	mw := multipart.NewWriter(dst)
+	w.Header().Set("Content-type", "multipart/byteranges; boundary="+mw.Boundary())
+	w.WriteHeader(206)
+	if r.Method == "HEAD" {
+		return
+	}
+	for _, ra := range ranges {
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Range": {ra.contentRange(d.size)},
+			"Content-Type":  {"application/octet-stream"},
+		})
+		if err == nil {
+			_, err = io.CopyN(part, io.NewSectionReader(f, ra.start, ra.length), ra.length)
+		}
+		if err != nil {
+			log.WithField("range", ra.contentRange(d.size)).WithField("err", err).Warningf("upload range err")
+			return
+		}
+	}
+	mw.Close()
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin && !freebsd
+
+package pget
+
+// freeSpace returns -1 as the free space is unknown on this platform.
+func freeSpace(path string) (int64, error) {
+	return -1, nil
+}
@@ -0,0 +1,89 @@
+package pget
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	STREAM_WINDOW = 8
+)
+
+// SetStreamOutput makes the download emit the file in order to w while the
+// batches are still fetched in parallel. At most window batches are buffered
+// waiting for an earlier one. When dst is not empty it is used as a spill
+// file, so the batches can still be seeded to peers.
+func (d *download) SetStreamOutput(w io.Writer, window int) {
+	if window <= 0 {
+		window = STREAM_WINDOW
+	}
+	d.stream = w
+	d.streamWindow = window
+	if d.dst == "" && d.serving() {
+		g.Warning("no spill file for stream output, disable upload")
+		d.th = nil
+		d.upload = false
+	}
+}
+
+func (d *download) startStream() {
+	d.streamSlots = make(chan struct{}, d.streamWindow)
+	d.streamPending = make(map[int64][]byte)
+	d.streamCond = sync.NewCond(&d.Mutex)
+	d.streamDone = make(chan bool)
+	d.streamHash = md5.New()
+	go d.streamLoop()
+}
+
+// streamLoop writes the batches to the stream output in order, releasing a
+// window slot for every batch written.
+func (d *download) streamLoop() {
+	dst := io.MultiWriter(d.stream, d.streamHash)
+	for batch := int64(0); batch*d.batchSize < d.size; batch++ {
+		d.Lock()
+		for d.streamPending[batch] == nil {
+			d.streamCond.Wait()
+		}
+		buf := d.streamPending[batch]
+		delete(d.streamPending, batch)
+		d.streamNext = batch + 1
+		d.Unlock()
+		if _, err := dst.Write(buf); err != nil {
+			d.fatalf("write stream output error:%v", err)
+		}
+		<-d.streamSlots
+	}
+	close(d.streamDone)
+}
+
+// streamBatch reads a whole batch into memory, writes it to the spill file
+// if any and hands it to streamLoop, unless an endgame attempt already did.
+func (d *download) streamBatch(batch int64, start int64, end int64, src io.Reader) error {
+	buf := make([]byte, end-start+1)
+	if _, err := io.ReadFull(src, buf); err != nil {
+		return errors.New(fmt.Sprintf("invalid length: %v", err))
+	}
+	if d.dst != "" {
+		f, err := d.openDst()
+		if err != nil {
+			d.fatalf("%v", err)
+		}
+		if _, err := f.WriteAt(buf, start); err != nil {
+			d.fatalf("%v", err)
+		}
+	}
+	d.Lock()
+	if batch >= d.streamNext && d.streamPending[batch] == nil {
+		d.streamPending[batch] = buf
+		d.streamCond.Broadcast()
+	}
+	d.Unlock()
+	return nil
+}
+
+func (d *download) streamMD5() string {
+	return fmt.Sprintf("%x", d.streamHash.Sum(nil))
+}
@@ -0,0 +1,51 @@
+package pget
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownload_StartStream(t *testing.T) {
+	runTestTrackerServer()
+	f, _ := os.Create("/tmp/source")
+	f.WriteString("hello,world")
+	f.Close()
+	defer os.Remove("/tmp/source")
+	out := &bytes.Buffer{}
+	d := NewDownload("http://localhost:33345/source", "", "", 3, "3cb95cfbe1035bce8c448fcaf80fe7d9", 2, false, 0, 3)
+	d.SetStreamOutput(out, 2)
+	done := make(chan bool)
+	go func() {
+		d.Start()
+		close(done)
+	}()
+	select {
+	case <-done:
+		assert.Equal(t, out.String(), "hello,world")
+	case <-time.After(1e9):
+		assert.True(t, false)
+	}
+}
+
+func TestDownload_StartStreamSpill(t *testing.T) {
+	runTestTrackerServer()
+	f, _ := os.Create("/tmp/source")
+	f.WriteString("hello,world")
+	f.Close()
+	defer os.Remove("/tmp/source")
+	spill := "/tmp/pget.spill"
+	defer os.Remove(spill)
+	out := &bytes.Buffer{}
+	d := NewDownload("http://localhost:33345/source", "", spill, 2, "", 3, false, 0, 3)
+	d.SetStreamOutput(out, 0)
+	assert.Equal(t, d.streamWindow, STREAM_WINDOW)
+	d.Start()
+	assert.Equal(t, out.String(), "hello,world")
+	buf, _ := ioutil.ReadFile(spill)
+	assert.Equal(t, string(buf), "hello,world")
+}
@@ -0,0 +1,132 @@
+package pget
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	CONNECT_TIMEOUT    = 10
+	FIRST_BYTE_TIMEOUT = 10
+	IDLE_TIMEOUT       = 10
+	// the deadline of a batch is this many times its expected duration
+	DEADLINE_FACTOR = 3
+	// weight of the last batch in the observed throughput
+	THROUGHPUT_WEIGHT = 0.3
+)
+
+// timeouts of a batch request, the overall deadline is at least batch and
+// grows with the batch size over the observed throughput.
+type timeouts struct {
+	connect   time.Duration
+	firstByte time.Duration
+	idle      time.Duration
+	batch     time.Duration
+}
+
+// SetTimeouts sets the timeout to connect, to receive the response header,
+// to receive the next bytes of the body, and the min deadline of a batch.
+// A zero value keeps the default.
+func (d *download) SetTimeouts(connect, firstByte, idle, batch time.Duration) {
+	if connect > 0 {
+		d.timeouts.connect = connect
+	}
+	if firstByte > 0 {
+		d.timeouts.firstByte = firstByte
+	}
+	if idle > 0 {
+		d.timeouts.idle = idle
+	}
+	if batch > 0 {
+		d.timeouts.batch = batch
+	}
+}
+
+// observeThroughput updates the throughput of a single batch request with
+// a batch of n bytes fetched in elapsed.
+func (d *download) observeThroughput(n int64, elapsed time.Duration) {
+	if elapsed <= 0 {
+		return
+	}
+	rate := float64(n) / elapsed.Seconds()
+	d.Lock()
+	defer d.Unlock()
+	if d.throughput == 0 {
+		d.throughput = rate
+	} else {
+		d.throughput = d.throughput*(1-THROUGHPUT_WEIGHT) + rate*THROUGHPUT_WEIGHT
+	}
+}
+
+// batchDeadline returns the overall deadline of a batch request of n bytes,
+// from the observed throughput and the share of the download rate limit of
+// a worker.
+func (d *download) batchDeadline(n int64) time.Duration {
+	d.Lock()
+	rate := d.throughput
+	workers := d.concurrent
+	if d.adaptive != nil && d.adaptive.target > 0 {
+		workers = d.adaptive.target
+	}
+	d.Unlock()
+	if limit := d.downloadRateLimit.Rate(); limit > 0 {
+		if workers < 1 {
+			workers = 1
+		}
+		limit := float64(limit) / float64(workers)
+		if rate == 0 || limit < rate {
+			rate = limit
+		}
+	}
+	deadline := d.timeouts.batch
+	if rate > 0 {
+		expected := time.Duration(float64(n) / rate * float64(time.Second))
+		if expected*DEADLINE_FACTOR > deadline {
+			deadline = expected * DEADLINE_FACTOR
+		}
+	}
+	return deadline
+}
+
+// idleReader cancels the request when a read waits more than idle for the
+// peer, the time spent between reads, e.g. in the rate limiter, isn't
+// counted.
+type idleReader struct {
+	r       io.Reader
+	idle    time.Duration
+	cancel  func()
+	timer   *time.Timer
+	mu      sync.Mutex
+	expired bool
+}
+
+func newIdleReader(r io.Reader, idle time.Duration, cancel func()) *idleReader {
+	return &idleReader{r: r, idle: idle, cancel: cancel}
+}
+
+func (i *idleReader) Read(p []byte) (n int, err error) {
+	if i.timer == nil {
+		i.timer = time.AfterFunc(i.idle, i.expire)
+	} else {
+		i.timer.Reset(i.idle)
+	}
+	n, err = i.r.Read(p)
+	i.timer.Stop()
+	i.mu.Lock()
+	expired := i.expired
+	i.mu.Unlock()
+	if err != nil && expired {
+		err = errors.New(fmt.Sprintf("no progress in %v", i.idle))
+	}
+	return n, err
+}
+
+func (i *idleReader) expire() {
+	i.mu.Lock()
+	i.expired = true
+	i.mu.Unlock()
+	i.cancel()
+}
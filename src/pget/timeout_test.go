@@ -0,0 +1,77 @@
+package pget
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownload_batchDeadline(t *testing.T) {
+	d := NewDownload("", "", "", 2, "", 1, false, 0, 3)
+	d.SetTimeouts(0, 0, 0, 5*time.Second)
+	assert.Equal(t, 5*time.Second, d.batchDeadline(1000))
+	// 100 bytes per second each worker
+	d.SetDownloadRate(200)
+	assert.Equal(t, 30*time.Second, d.batchDeadline(1000))
+	// a slower throughput than the limit
+	d.observeThroughput(500, 10*time.Second)
+	assert.Equal(t, 60*time.Second, d.batchDeadline(1000))
+	// never below the min deadline
+	assert.Equal(t, 5*time.Second, d.batchDeadline(1))
+}
+
+func TestDownload_observeThroughput(t *testing.T) {
+	d := NewDownload("", "", "", 1, "", 1, false, 0, 3)
+	d.observeThroughput(100, time.Second)
+	assert.Equal(t, float64(100), d.throughput)
+	d.observeThroughput(200, time.Second)
+	assert.InDelta(t, 130, d.throughput, 0.001)
+}
+
+func TestDownload_downloadBatchIdleTimeout(t *testing.T) {
+	stop := make(chan bool)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Range", "bytes 0-10/11")
+		w.WriteHeader(206)
+		w.Write([]byte("hello"))
+		w.(http.Flusher).Flush()
+		<-stop
+	}))
+	defer ts.Close()
+	// before Close, which waits for the handler
+	defer close(stop)
+	dst := "/tmp/pget_idle"
+	defer os.Remove(dst)
+	d := NewDownload(ts.URL, "", dst, 1, "", 11, false, 0, 3)
+	d.size = 11
+	d.SetTimeouts(0, 0, 100*time.Millisecond, 0)
+	begin := time.Now()
+	err := d.downloadBatch(ts.URL+"/peer", 0)
+	assert.NotNil(t, err)
+	assert.True(t, strings.Contains(err.Error(), "no progress"))
+	assert.True(t, time.Since(begin) < 5*time.Second)
+	d.closeDst()
+}
+
+func TestDownload_downloadBatchFirstByteTimeout(t *testing.T) {
+	stop := make(chan bool)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-stop
+	}))
+	defer ts.Close()
+	// before Close, which waits for the handler
+	defer close(stop)
+	d := NewDownload(ts.URL, "", "", 1, "", 11, false, 0, 3)
+	d.size = 11
+	d.SetTimeouts(0, 100*time.Millisecond, 0, 0)
+	begin := time.Now()
+	err := d.downloadBatch(ts.URL+"/peer", 0)
+	assert.NotNil(t, err)
+	assert.True(t, strings.Contains(err.Error(), "timeout"))
+	assert.True(t, time.Since(begin) < 5*time.Second)
+}
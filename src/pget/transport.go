@@ -0,0 +1,127 @@
+package pget
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	KEEPALIVE         = 30
+	IDLE_CONN_TIMEOUT = 90
+)
+
+// TransportOptions tune the http transport shared by the requests of a
+// download to the origin, the peers and the tracker.
+type TransportOptions struct {
+	// idle conns kept per host, 0 sizes it to the concurrency
+	MaxIdleConnsPerHost int
+	// 0 uses the connect timeout of the download
+	DialTimeout time.Duration
+	// tcp keep-alive period, 0 is KEEPALIVE seconds and negative disables it
+	KeepAlive    time.Duration
+	DisableHTTP2 bool
+	// proxy url, http, https or socks5, of every request. The environment
+	// (HTTP_PROXY, ...) is used if empty and PROXY_DIRECT connects directly
+	Proxy string
+	// proxies of the origin, the tracker and the peers, Proxy if empty
+	OriginProxy  string
+	TrackerProxy string
+	PeerProxy    string
+	// NO_PROXY style list of the hosts reached directly
+	NoProxy string
+	// curl style host:port:addr, addr is dialed instead of host:port
+	Resolve []string
+}
+
+// NewTransport returns a transport with the options.
+func NewTransport(opts TransportOptions) (*http.Transport, error) {
+	proxy, err := parseProxy(opts.Proxy, parseNoProxy(opts.NoProxy))
+	if err != nil {
+		return nil, err
+	}
+	resolve, err := parseResolve(opts.Resolve)
+	if err != nil {
+		return nil, err
+	}
+	keepAlive := opts.KeepAlive
+	if keepAlive == 0 {
+		keepAlive = KEEPALIVE * time.Second
+	}
+	t := &http.Transport{
+		Proxy: proxy,
+		DialContext: resolveDial((&net.Dialer{
+			Timeout:   opts.DialTimeout,
+			KeepAlive: keepAlive,
+		}).DialContext, resolve),
+		TLSHandshakeTimeout: opts.DialTimeout,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: opts.MaxIdleConnsPerHost,
+		IdleConnTimeout:     IDLE_CONN_TIMEOUT * time.Second,
+		DisableKeepAlives:   keepAlive < 0,
+		ForceAttemptHTTP2:   !opts.DisableHTTP2,
+	}
+	if opts.DisableHTTP2 {
+		t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	return t, nil
+}
+
+// SetTransportOptions tunes the shared transport, it must be called before
+// the download starts.
+func (d *download) SetTransportOptions(opts TransportOptions) error {
+	if _, err := NewTransport(opts); err != nil {
+		return err
+	}
+	if _, err := d.proxy(opts); err != nil {
+		return err
+	}
+	d.transportOptions = opts
+	return nil
+}
+
+// client returns the http client shared by the requests of the download,
+// the tracker helper uses it too. It's built on the first request, which is
+// getSize.
+func (d *download) client() *http.Client {
+	d.clientOnce.Do(func() {
+		opts := d.transportOptions
+		if opts.DialTimeout == 0 {
+			opts.DialTimeout = d.timeouts.connect
+		}
+		if opts.MaxIdleConnsPerHost == 0 {
+			opts.MaxIdleConnsPerHost = d.maxConns()
+		}
+		// checked by SetTransportOptions
+		t, err := NewTransport(opts)
+		if err != nil {
+			d.fatalf("%v", err)
+		}
+		if t.Proxy, err = d.proxy(opts); err != nil {
+			d.fatalf("%v", err)
+		}
+		t.ResponseHeaderTimeout = d.timeouts.firstByte
+		d.httpClient = &http.Client{Transport: t}
+		if d.th != nil {
+			d.th.Client = d.httpClient
+		}
+	})
+	return d.httpClient
+}
+
+// maxConns returns how many requests the download can have in flight to a
+// single host.
+func (d *download) maxConns() int {
+	n := d.concurrent
+	if d.adaptive != nil && d.adaptive.max > n {
+		n = d.adaptive.max
+	}
+	if d.pieceSize > 0 {
+		n *= PIECE_CONCURRENT
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
@@ -0,0 +1,70 @@
+package pget
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewTransport(t *testing.T) {
+	_, err := NewTransport(TransportOptions{Proxy: "::"})
+	assert.NotNil(t, err)
+
+	tr, err := NewTransport(TransportOptions{Proxy: "http://proxy:3128", MaxIdleConnsPerHost: 8, DisableHTTP2: true})
+	assert.Nil(t, err)
+	assert.Equal(t, 8, tr.MaxIdleConnsPerHost)
+	assert.False(t, tr.ForceAttemptHTTP2)
+	assert.NotNil(t, tr.TLSNextProto)
+	req, _ := http.NewRequest("GET", "http://source.com/", nil)
+	proxy, err := tr.Proxy(req)
+	assert.Nil(t, err)
+	assert.Equal(t, "proxy:3128", proxy.Host)
+
+	tr, err = NewTransport(TransportOptions{KeepAlive: -1})
+	assert.Nil(t, err)
+	assert.True(t, tr.DisableKeepAlives)
+}
+
+func TestDownload_client(t *testing.T) {
+	d := NewDownload("http://localhost/", "http://localhost", "", 3, "", 1, true, 0, 3)
+	d.SetAdaptiveConcurrency(1, 10)
+	assert.NotNil(t, d.SetTransportOptions(TransportOptions{Proxy: "::"}))
+	c := d.client()
+	assert.Equal(t, 10, c.Transport.(*http.Transport).MaxIdleConnsPerHost)
+	// shared with the tracker
+	assert.Equal(t, c, d.th.Client)
+	assert.Equal(t, c, d.client())
+}
+
+func TestDownload_StartReuseConn(t *testing.T) {
+	var lock sync.Mutex
+	conns := 0
+	modTime := time.Now()
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "source", modTime, bytes.NewReader([]byte("hello,world")))
+	}))
+	ts.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			lock.Lock()
+			conns += 1
+			lock.Unlock()
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+	dst := "/tmp/pget_reuse"
+	defer os.Remove(dst)
+	d := NewDownload(ts.URL, "", dst, 1, "", 2, false, 0, 3)
+	d.Start()
+	lock.Lock()
+	defer lock.Unlock()
+	// the HEAD and the 6 batches
+	assert.Equal(t, 1, conns)
+}
@@ -0,0 +1,178 @@
+package pget
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	METRICS_PATH = "/.well-known/pget/metrics"
+)
+
+// uploadMetrics are the counters of an upload server.
+type uploadMetrics struct {
+	Requests int64 `json:"requests"`
+	Rejected int64 `json:"rejected"`
+	Bytes    int64 `json:"bytes"`
+	Active   int   `json:"active"`
+}
+
+// uploadSlots limits the concurrent uploads and shares them fairly between
+// the clients, a request may wait queueTime for a free slot.
+type uploadSlots struct {
+	sync.Mutex
+	concurrent int
+	cur        int
+	// slots of every client and the clients waiting for one
+	clients map[string]int
+	waiting map[string]int
+	// closed and replaced when a slot is released
+	freed     chan struct{}
+	queueTime time.Duration
+	metrics   uploadMetrics
+}
+
+func newUploadSlots(concurrent int) *uploadSlots {
+	return &uploadSlots{
+		concurrent: concurrent,
+		clients:    make(map[string]int),
+		waiting:    make(map[string]int),
+		freed:      make(chan struct{}),
+	}
+}
+
+// canAcquire reports whether client may take a slot, a client can't have
+// more than its share of the slots among the active and waiting clients.
+// Must be called with the lock held.
+func (s *uploadSlots) canAcquire(client string) bool {
+	if s.cur >= s.concurrent {
+		return false
+	}
+	clients := len(s.clients)
+	for c := range s.waiting {
+		if _, ok := s.clients[c]; !ok {
+			clients += 1
+		}
+	}
+	_, active := s.clients[client]
+	_, waiting := s.waiting[client]
+	if !active && !waiting {
+		clients += 1
+	}
+	share := s.concurrent / clients
+	if share < 1 {
+		share = 1
+	}
+	return s.clients[client] < share
+}
+
+// acquire takes a slot for client, waiting at most queueTime for one to be
+// released or until stop is closed.
+func (s *uploadSlots) acquire(client string, stop chan bool) bool {
+	deadline := time.Now().Add(s.queueTime)
+	queued := false
+	for {
+		s.Lock()
+		if s.canAcquire(client) {
+			s.cur += 1
+			s.clients[client] += 1
+			s.metrics.Requests += 1
+			s.Unlock()
+			return true
+		}
+		freed := s.freed
+		wait := deadline.Sub(time.Now())
+		if wait <= 0 {
+			s.metrics.Rejected += 1
+			s.Unlock()
+			return false
+		}
+		if !queued {
+			queued = true
+			s.waiting[client] += 1
+			defer s.unqueue(client)
+		}
+		s.Unlock()
+		timer := time.NewTimer(wait)
+		select {
+		case <-freed:
+			timer.Stop()
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
+			return false
+		}
+	}
+}
+
+func (s *uploadSlots) unqueue(client string) {
+	s.Lock()
+	defer s.Unlock()
+	s.waiting[client] -= 1
+	if s.waiting[client] <= 0 {
+		delete(s.waiting, client)
+	}
+}
+
+func (s *uploadSlots) release(client string) {
+	s.Lock()
+	defer s.Unlock()
+	s.cur -= 1
+	s.clients[client] -= 1
+	if s.clients[client] <= 0 {
+		delete(s.clients, client)
+	}
+	close(s.freed)
+	s.freed = make(chan struct{})
+}
+
+func (s *uploadSlots) snapshot() uploadMetrics {
+	s.Lock()
+	defer s.Unlock()
+	m := s.metrics
+	m.Active = s.cur
+	return m
+}
+
+func (s *uploadSlots) serveMetrics(w http.ResponseWriter) {
+	w.Header().Set("Content-type", "application/json")
+	json.NewEncoder(w).Encode(s.snapshot())
+}
+
+// writer limits the rate of w with limiter if any and counts the bytes
+// uploaded.
+func (s *uploadSlots) writer(w io.Writer, limiter *Limiter) io.Writer {
+	if limiter != nil {
+		w = limiter.Writer(w)
+	}
+	return &countWriter{w: w, slots: s}
+}
+
+type countWriter struct {
+	w     io.Writer
+	slots *uploadSlots
+}
+
+func (c *countWriter) Write(p []byte) (n int, err error) {
+	n, err = c.w.Write(p)
+	c.slots.Lock()
+	c.slots.metrics.Bytes += int64(n)
+	c.slots.Unlock()
+	return
+}
+
+// clientList returns the clients being uploaded to.
+func (s *uploadSlots) clientList() []string {
+	s.Lock()
+	defer s.Unlock()
+	clients := []string{}
+	for client := range s.clients {
+		clients = append(clients, client)
+	}
+	sort.Strings(clients)
+	return clients
+}
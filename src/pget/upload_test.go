@@ -0,0 +1,66 @@
+package pget
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadSlots_canAcquire(t *testing.T) {
+	s := newUploadSlots(4)
+	s.cur = 4
+	s.clients["a"] = 4
+	assert.False(t, s.canAcquire("b"))
+	s.cur = 3
+	s.clients["a"] = 3
+	assert.True(t, s.canAcquire("a"))
+	assert.True(t, s.canAcquire("b"))
+	// a has more than its share now that b is waiting
+	s.waiting["b"] = 1
+	assert.False(t, s.canAcquire("a"))
+	assert.True(t, s.canAcquire("b"))
+}
+
+func TestUploadSlots_acquire(t *testing.T) {
+	s := newUploadSlots(1)
+	assert.True(t, s.acquire("a", nil))
+	assert.False(t, s.acquire("a", nil))
+	s.queueTime = time.Second
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		s.release("a")
+	}()
+	assert.True(t, s.acquire("b", nil))
+	assert.Equal(t, s.clients, map[string]int{"b": 1})
+	assert.Len(t, s.waiting, 0)
+	m := s.snapshot()
+	assert.Equal(t, m.Requests, int64(2))
+	assert.Equal(t, m.Rejected, int64(1))
+	assert.Equal(t, m.Active, 1)
+}
+
+func TestUploadSlots_writer(t *testing.T) {
+	s := newUploadSlots(1)
+	buf := &bytes.Buffer{}
+	w := s.writer(buf, nil)
+	w.Write([]byte("hello"))
+	assert.Equal(t, buf.String(), "hello")
+	assert.Equal(t, s.snapshot().Bytes, int64(5))
+}
+
+func TestDownload_ServeHTTPMetrics(t *testing.T) {
+	d := NewDownload("http://localhost/", "http://localhost", "", 1, "", 1, true, 0, 0)
+	d.httpServer()
+	http.Get(fmt.Sprintf("http://localhost:%d", d.httpListenPort))
+	res, err := http.Get(fmt.Sprintf("http://localhost:%d%s", d.httpListenPort, METRICS_PATH))
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	var m uploadMetrics
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&m))
+	assert.Equal(t, m.Rejected, int64(1))
+}
@@ -41,3 +41,34 @@ func MD5sum(filename string) (string, error) {
 	checksum := fmt.Sprintf("%x", hash.Sum(nil))
 	return checksum, nil
 }
+
+// BatchMD5sums returns the MD5 checksum of filename and of each of its
+// batches of batchSize bytes.
+func BatchMD5sums(filename string, batchSize int64) (string, []string, error) {
+	if batchSize <= 0 {
+		return "", nil, errors.New(fmt.Sprintf("invalid batch size %d", batchSize))
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", nil, err
+	}
+	defer file.Close()
+
+	hash := md5.New()
+	var batches []string
+	reader := bufio.NewReader(file)
+	for {
+		batchHash := md5.New()
+		n, err := io.CopyN(io.MultiWriter(hash, batchHash), reader, batchSize)
+		if n > 0 {
+			batches = append(batches, fmt.Sprintf("%x", batchHash.Sum(nil)))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), batches, nil
+}
@@ -15,3 +15,16 @@ func TestMD5sum(t *testing.T) {
 	md5, _ := MD5sum("/tmp/test.txt")
 	assert.Equal(t, md5, "2e9dd21c7bf65eb6c8337e58c658d44c")
 }
+
+func TestBatchMD5sums(t *testing.T) {
+
+	f, _ := os.Create("/tmp/test.txt")
+	f.WriteString("hello,wrold")
+	f.Close()
+	md5, batches, err := BatchMD5sums("/tmp/test.txt", 6)
+	assert.NoError(t, err)
+	assert.Equal(t, md5, "2e9dd21c7bf65eb6c8337e58c658d44c")
+	assert.Len(t, batches, 2)
+	_, batches, _ = BatchMD5sums("/tmp/test.txt", 11)
+	assert.Equal(t, batches, []string{md5})
+}
@@ -0,0 +1,106 @@
+package tracker
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// distances between two localities, the nearest first
+const (
+	LOCALITY_RACK = iota
+	LOCALITY_ZONE
+	LOCALITY_DC
+	// a label of one of them is missing
+	LOCALITY_UNKNOWN
+	// in another datacenter
+	LOCALITY_REMOTE
+)
+
+// Locality are the topology labels of a peer, a rack is in a zone which is
+// in a datacenter, empty labels are unknown.
+type Locality struct {
+	DC   string `json:"dc,omitempty"`
+	Zone string `json:"zone,omitempty"`
+	Rack string `json:"rack,omitempty"`
+}
+
+// ParseLocality parses labels like dc=us-east,zone=us-east-1a,rack=r12, all
+// of them are optional.
+func ParseLocality(s string) (l Locality, err error) {
+	for _, label := range strings.Split(s, ",") {
+		label = strings.TrimSpace(label)
+		if label == "" {
+			continue
+		}
+		kv := strings.SplitN(label, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return l, errors.New(fmt.Sprintf("invalid locality label:%s", label))
+		}
+		switch kv[0] {
+		case "dc":
+			l.DC = kv[1]
+		case "zone":
+			l.Zone = kv[1]
+		case "rack":
+			l.Rack = kv[1]
+		default:
+			return l, errors.New(fmt.Sprintf("unknown locality label:%s", kv[0]))
+		}
+	}
+	return l, nil
+}
+
+func (l Locality) String() string {
+	var labels []string
+	if l.DC != "" {
+		labels = append(labels, "dc="+l.DC)
+	}
+	if l.Zone != "" {
+		labels = append(labels, "zone="+l.Zone)
+	}
+	if l.Rack != "" {
+		labels = append(labels, "rack="+l.Rack)
+	}
+	return strings.Join(labels, ",")
+}
+
+func (l Locality) IsZero() bool {
+	return l == Locality{}
+}
+
+// Distance returns how far o is from l, a label only counts when it's set
+// on both, a rack only within the same zone.
+func (l Locality) Distance(o Locality) int {
+	if l.DC != "" && o.DC != "" && l.DC != o.DC {
+		return LOCALITY_REMOTE
+	}
+	if l.Zone != "" && l.Zone == o.Zone {
+		if l.Rack != "" && l.Rack == o.Rack {
+			return LOCALITY_RACK
+		}
+		return LOCALITY_ZONE
+	}
+	if l.DC != "" && l.DC == o.DC {
+		return LOCALITY_DC
+	}
+	return LOCALITY_UNKNOWN
+}
+
+// Nearest sorts peers by their distance to from, keeping the order of the
+// peers as far, the ones in another datacenter are dropped unless crossDC.
+func Nearest(peers []string, from Locality, crossDC bool, locality func(peer string) Locality) []string {
+	distance := make(map[string]int, len(peers))
+	near := make([]string, 0, len(peers))
+	for _, peer := range peers {
+		distance[peer] = from.Distance(locality(peer))
+		if crossDC || distance[peer] != LOCALITY_REMOTE {
+			near = append(near, peer)
+		}
+	}
+	sort.SliceStable(near, func(i, j int) bool {
+		return distance[near[i]] < distance[near[j]]
+	})
+	return near
+}
@@ -1,9 +1,11 @@
 package tracker
 
 import (
+	"errors"
 	"fmt"
 	"logger"
 	"net/http"
+	"net/url"
 	"strconv"
 	"sync"
 	"time"
@@ -21,6 +23,8 @@ type track struct {
 	addr           string
 	sourceBatchMap map[string]map[int64]map[int64][]string
 	sourceExpire   map[string]time.Time
+	// locality labels of the peers of a source
+	sourceLocality map[string]map[string]Locality
 	sync.Mutex
 	expireTTL int
 }
@@ -51,11 +55,54 @@ func (t *track) addPeer(source string, peer string, batch int64, batch_size int6
 		t.sourceBatchMap[source][batch] = make(map[int64][]string)
 	}
 
-	t.sourceBatchMap[source][batch][batch_size] = append(t.sourceBatchMap[source][batch][batch_size], peer)
+	exist := false
+	for _, p := range t.sourceBatchMap[source][batch][batch_size] {
+		if p == peer {
+			// a heartbeat of a seeding peer
+			exist = true
+			break
+		}
+	}
+	if !exist {
+		t.sourceBatchMap[source][batch][batch_size] = append(t.sourceBatchMap[source][batch][batch_size], peer)
+	}
 
 	t.sourceExpire[source] = time.Now()
 }
 
+// setLocality records the labels of a peer of source.
+func (t *track) setLocality(source string, peer string, l Locality) {
+
+	t.Lock()
+	defer t.Unlock()
+	if t.sourceLocality == nil {
+		t.sourceLocality = make(map[string]map[string]Locality)
+	}
+	if _, ok := t.sourceLocality[source]; !ok {
+		t.sourceLocality[source] = make(map[string]Locality)
+	}
+	if l.IsZero() {
+		delete(t.sourceLocality[source], peer)
+	} else {
+		t.sourceLocality[source][peer] = l
+	}
+}
+
+func (t *track) getLocality(source string, peer string) Locality {
+
+	t.Lock()
+	defer t.Unlock()
+	return t.sourceLocality[source][peer]
+}
+
+// getNearPeer returns the peers of batch sorted by their distance to from,
+// the ones in another datacenter are dropped unless crossDC.
+func (t *track) getNearPeer(source string, batch int64, batch_size int64, from Locality, crossDC bool) []string {
+	return Nearest(t.getPeer(source, batch, batch_size), from, crossDC, func(peer string) Locality {
+		return t.getLocality(source, peer)
+	})
+}
+
 func (t *track) getPeer(source string, batch int64, batch_size int64) []string {
 
 	t.Lock()
@@ -74,11 +121,31 @@ func (t *track) deleteSource() {
 	defer t.Unlock()
 	for k, v := range t.sourceExpire {
 		if int(time.Since(v).Seconds()) > t.expireTTL {
-			g.Debugf("source:%s expire, will delete ... \n", k)
+			logger.WithFields(logger.Fields{"source": k}).Debugf("source expire, will delete")
 			delete(t.sourceExpire, k)
 			delete(t.sourceBatchMap, k)
+			delete(t.sourceLocality, k)
+		}
+	}
+}
+
+// sourceKey keeps peers of different versions of the same source apart.
+func sourceKey(source string, version string) string {
+	if source == "" || version == "" {
+		return source
+	}
+	return source + "#" + version
+}
+
+// localityQuery returns the locality labels of a request.
+func localityQuery(q url.Values) (Locality, error) {
+	l := Locality{DC: q.Get("dc"), Zone: q.Get("zone"), Rack: q.Get("rack")}
+	for _, label := range []string{l.DC, l.Zone, l.Rack} {
+		if strings.ContainsAny(label, " ,=\n") {
+			return l, errors.New(fmt.Sprintf("invalid locality label:%s", label))
 		}
 	}
+	return l, nil
 }
 
 func (t *track) Server() {
@@ -96,7 +163,7 @@ func (t *track) Server() {
 
 func (t *track) serverHTTP(w http.ResponseWriter, r *http.Request) {
 
-	source := r.URL.Query().Get("source")
+	source := sourceKey(r.URL.Query().Get("source"), r.URL.Query().Get("version"))
 	batch := r.URL.Query().Get("batch")
 	batch_size := r.URL.Query().Get("batch_size")
 	if source == "" || batch == "" || batch_size == "" {
@@ -119,12 +186,26 @@ func (t *track) serverHTTP(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(err.Error()))
 		return
 	}
+	locality, err := localityQuery(r.URL.Query())
+	if err != nil {
+		g.Debug(err)
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
 	switch r.Method {
 	case "GET":
 		w.WriteHeader(200)
-		peers := t.getPeer(source, bat, bat_size)
+		// the nearest peers of the requester first
+		peers := t.getNearPeer(source, bat, bat_size, locality, r.URL.Query().Get("cross_dc") != "0")
+		logger.WithFields(logger.Fields{"source": source, "batch": bat, "peers": len(peers)}).Debugf("get peers")
+		labels := r.URL.Query().Get("labels") == "1"
 		for _, peer := range peers {
-			fmt.Fprintln(w, peer)
+			if l := t.getLocality(source, peer); labels && !l.IsZero() {
+				fmt.Fprintf(w, "%s %s\n", peer, l)
+			} else {
+				fmt.Fprintln(w, peer)
+			}
 		}
 		return
 	case "PUT":
@@ -142,9 +223,13 @@ func (t *track) serverHTTP(w http.ResponseWriter, r *http.Request) {
 			ip = strings.Split(r.RemoteAddr, ":")[0]
 		}
 		peer := fmt.Sprintf("http://%s:%s", ip, port)
+		if path := r.URL.Query().Get("path"); strings.HasPrefix(path, "/") {
+			peer += path
+		}
 		t.addPeer(source, peer, bat, bat_size)
+		t.setLocality(source, peer, locality)
 		w.WriteHeader(200)
-		g.Debugf("%s have batch:%d for %s", peer, bat, source)
+		logger.WithFields(logger.Fields{"source": source, "batch": bat, "peer": peer}).Debugf("add peer")
 		return
 
 	}
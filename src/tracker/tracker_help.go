@@ -5,15 +5,36 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strings"
 
 	"gopkg.in/bufio.v1"
 )
 
 type TrackerHelper struct {
-	SourceURL     string
-	TrackerURL    string
+	SourceURL  string
+	TrackerURL string
+	// Version identifies the source version (ETag or Last-Modified),
+	// peers only share batches with peers of the same version
+	Version string
+	// PeerPath is appended to the peer url, for peers which don't serve
+	// the file at their root
+	PeerPath string
+	// Locality labels of the peer, the tracker returns the nearest peers
+	// first, DenyCrossDC drops the ones in another datacenter
+	Locality      Locality
+	DenyCrossDC   bool
 	RequestHeader [][2]string
+	// Client sends the requests, e.g. to share the transport of a
+	// download, http.DefaultClient if nil
+	Client *http.Client
+}
+
+func (t *TrackerHelper) client() *http.Client {
+	if t.Client != nil {
+		return t.Client
+	}
+	return http.DefaultClient
 }
 
 func (t *TrackerHelper) setHeader(req *http.Request) {
@@ -26,6 +47,18 @@ func (t *TrackerHelper) setHeader(req *http.Request) {
 	}
 }
 
+func (t *TrackerHelper) addLocality(q url.Values) {
+	if t.Locality.DC != "" {
+		q.Add("dc", t.Locality.DC)
+	}
+	if t.Locality.Zone != "" {
+		q.Add("zone", t.Locality.Zone)
+	}
+	if t.Locality.Rack != "" {
+		q.Add("rack", t.Locality.Rack)
+	}
+}
+
 func (t *TrackerHelper) PutPeer(port string, bat int64, bat_size int64) (err error) {
 	req, err := http.NewRequest("PUT", t.TrackerURL, nil)
 	if err != nil {
@@ -34,14 +67,19 @@ func (t *TrackerHelper) PutPeer(port string, bat int64, bat_size int64) (err err
 	t.setHeader(req)
 	q := req.URL.Query()
 	q.Add("source", t.SourceURL)
+	if t.Version != "" {
+		q.Add("version", t.Version)
+	}
 	q.Add("port", port)
+	if t.PeerPath != "" {
+		q.Add("path", t.PeerPath)
+	}
 	q.Add("batch", fmt.Sprintf("%d", bat))
 	q.Add("batch_size", fmt.Sprintf("%d", bat_size))
+	t.addLocality(q)
 	req.URL.RawQuery = q.Encode()
 
-	client := &http.Client{}
-
-	resp, err := client.Do(req)
+	resp, err := t.client().Do(req)
 
 	if err != nil {
 		return
@@ -51,43 +89,67 @@ func (t *TrackerHelper) PutPeer(port string, bat int64, bat_size int64) (err err
 	resp_body, _ := ioutil.ReadAll(resp.Body)
 
 	if resp.StatusCode != 200 {
-		return errors.New(fmt.Sprintf("http code is %s, body is %s", resp.StatusCode, resp_body))
+		return errors.New(fmt.Sprintf("http code is %d, body is %s", resp.StatusCode, resp_body))
 	}
 	return
 }
 
 func (t *TrackerHelper) GetPeer(bat int64, bat_size int64) (peers []string, err error) {
+	peers, _, err = t.GetPeerLocality(bat, bat_size)
+	return peers, err
+}
+
+// GetPeerLocality returns the peers of a batch, the nearest first, and the
+// locality labels of the ones which announced them.
+func (t *TrackerHelper) GetPeerLocality(bat int64, bat_size int64) (peers []string, locality map[string]Locality, err error) {
+	locality = make(map[string]Locality)
 	req, err := http.NewRequest("GET", t.TrackerURL, nil)
 	if err != nil {
-		return []string{}, err
+		return []string{}, locality, err
 	}
 	t.setHeader(req)
 	q := req.URL.Query()
 	q.Add("source", t.SourceURL)
+	if t.Version != "" {
+		q.Add("version", t.Version)
+	}
 	q.Add("batch", fmt.Sprintf("%d", bat))
 	q.Add("batch_size", fmt.Sprintf("%d", bat_size))
+	t.addLocality(q)
+	if t.DenyCrossDC {
+		q.Add("cross_dc", "0")
+	}
+	q.Add("labels", "1")
 	req.URL.RawQuery = q.Encode()
 
-	client := &http.Client{}
-
-	resp, err := client.Do(req)
+	resp, err := t.client().Do(req)
 
 	if err != nil {
-		return []string{}, err
+		return []string{}, locality, err
 	}
 	defer resp.Body.Close()
 	resp_body, _ := ioutil.ReadAll(resp.Body)
 
 	if resp.StatusCode != 200 {
-		return []string{}, errors.New(fmt.Sprintf("http code is %d, body is %s", resp.StatusCode, resp_body))
+		return []string{}, locality, errors.New(fmt.Sprintf("http code is %d, body is %s", resp.StatusCode, resp_body))
 	}
 	buf := bufio.NewBuffer(resp_body)
 	for {
-		peer, err := buf.ReadString('\n')
+		line, err := buf.ReadString('\n')
 		if err != nil {
 			break
 		}
-		peers = append(peers, strings.TrimSpace(peer))
+		// the peer and its labels, if any
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		peers = append(peers, fields[0])
+		if len(fields) > 1 {
+			if l, err := ParseLocality(fields[1]); err == nil {
+				locality[fields[0]] = l
+			}
+		}
 	}
-	return peers, nil
+	return peers, locality, nil
 }
@@ -37,6 +37,7 @@ func TestTracker_addPeer(t *testing.T) {
 	tracker := &track{}
 	tracker.addPeer("1", "1", 1, 1)
 	tracker.addPeer("1", "2", 1, 1)
+	tracker.addPeer("1", "1", 1, 1)
 
 	e, ok := tracker.sourceExpire["1"]
 	assert.True(t, ok)
@@ -115,3 +116,119 @@ func TestTrackerHelper_PutPeer(t *testing.T) {
 	assert.Equal(t, len(peers), 1)
 	assert.Contains(t, peers[0], "12345")
 }
+
+func TestTrackerHelper_Version(t *testing.T) {
+	runTestServer()
+	th := TrackerHelper{SourceURL: "http://source.com/version.pkg", TrackerURL: "http://localhost:12345", Version: "v1"}
+	err := th.PutPeer("12345", 1, 1)
+	assert.NoError(t, err)
+	peers, err := th.GetPeer(1, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, len(peers), 1)
+
+	th.Version = "v2"
+	peers, err = th.GetPeer(1, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, len(peers), 0)
+}
+
+func TestTrackerHelper_PeerPath(t *testing.T) {
+	runTestServer()
+	th := TrackerHelper{SourceURL: "http://source.com/path.pkg", TrackerURL: "http://localhost:12345", PeerPath: "/pkgs/path.pkg"}
+	err := th.PutPeer("8080", 1, 1)
+	assert.NoError(t, err)
+	peers, err := th.GetPeer(1, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, len(peers), 1)
+	assert.Contains(t, peers[0], ":8080/pkgs/path.pkg")
+}
+
+type countTransport struct {
+	n int
+}
+
+func (c *countTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.n += 1
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestTrackerHelper_Client(t *testing.T) {
+	runTestServer()
+	transport := &countTransport{}
+	th := TrackerHelper{SourceURL: "http://source.com/client.pkg", TrackerURL: "http://localhost:12345", Client: &http.Client{Transport: transport}}
+	assert.NoError(t, th.PutPeer("12345", 1, 1))
+	_, err := th.GetPeer(1, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, transport.n)
+}
+
+func TestParseLocality(t *testing.T) {
+	l, err := ParseLocality("dc=us-east, zone=us-east-1a,rack=r1")
+	assert.NoError(t, err)
+	assert.Equal(t, Locality{DC: "us-east", Zone: "us-east-1a", Rack: "r1"}, l)
+	assert.Equal(t, "dc=us-east,zone=us-east-1a,rack=r1", l.String())
+	l, err = ParseLocality("")
+	assert.NoError(t, err)
+	assert.True(t, l.IsZero())
+	_, err = ParseLocality("dc")
+	assert.Error(t, err)
+	_, err = ParseLocality("region=eu")
+	assert.Error(t, err)
+}
+
+func TestLocality_Distance(t *testing.T) {
+	l := Locality{DC: "a", Zone: "a1", Rack: "r1"}
+	assert.Equal(t, LOCALITY_RACK, l.Distance(Locality{DC: "a", Zone: "a1", Rack: "r1"}))
+	assert.Equal(t, LOCALITY_ZONE, l.Distance(Locality{DC: "a", Zone: "a1", Rack: "r2"}))
+	assert.Equal(t, LOCALITY_ZONE, l.Distance(Locality{Zone: "a1"}))
+	assert.Equal(t, LOCALITY_DC, l.Distance(Locality{DC: "a", Zone: "a2", Rack: "r1"}))
+	assert.Equal(t, LOCALITY_UNKNOWN, l.Distance(Locality{}))
+	assert.Equal(t, LOCALITY_REMOTE, l.Distance(Locality{DC: "b", Zone: "a1", Rack: "r1"}))
+	assert.Equal(t, LOCALITY_UNKNOWN, Locality{}.Distance(l))
+}
+
+func TestTracker_getNearPeer(t *testing.T) {
+	tracker := &track{}
+	for _, peer := range []string{"remote", "unknown", "dc", "zone", "rack"} {
+		tracker.addPeer("1", peer, 1, 1)
+	}
+	tracker.setLocality("1", "remote", Locality{DC: "b"})
+	tracker.setLocality("1", "dc", Locality{DC: "a", Zone: "a2"})
+	tracker.setLocality("1", "zone", Locality{DC: "a", Zone: "a1", Rack: "r2"})
+	tracker.setLocality("1", "rack", Locality{DC: "a", Zone: "a1", Rack: "r1"})
+	from := Locality{DC: "a", Zone: "a1", Rack: "r1"}
+	assert.Equal(t, []string{"rack", "zone", "dc", "unknown", "remote"}, tracker.getNearPeer("1", 1, 1, from, true))
+	assert.Equal(t, []string{"rack", "zone", "dc", "unknown"}, tracker.getNearPeer("1", 1, 1, from, false))
+	// without labels the order is kept
+	assert.Equal(t, []string{"remote", "unknown", "dc", "zone", "rack"}, tracker.getNearPeer("1", 1, 1, Locality{}, false))
+	// the peers aren't sorted in place
+	assert.Equal(t, "remote", tracker.getPeer("1", 1, 1)[0])
+}
+
+func TestTrackerHelper_Locality(t *testing.T) {
+	runTestServer()
+	source := "http://source.com/locality.pkg"
+	far := TrackerHelper{SourceURL: source, TrackerURL: "http://localhost:12345", Locality: Locality{DC: "b"}}
+	assert.NoError(t, far.PutPeer("1001", 1, 1))
+	near := TrackerHelper{SourceURL: source, TrackerURL: "http://localhost:12345", Locality: Locality{DC: "a", Zone: "a1"}}
+	assert.NoError(t, near.PutPeer("1002", 1, 1))
+
+	th := TrackerHelper{SourceURL: source, TrackerURL: "http://localhost:12345", Locality: Locality{DC: "a", Zone: "a1", Rack: "r1"}}
+	peers, locality, err := th.GetPeerLocality(1, 1)
+	assert.NoError(t, err)
+	assert.Len(t, peers, 2)
+	assert.Contains(t, peers[0], ":1002")
+	assert.Equal(t, Locality{DC: "a", Zone: "a1"}, locality[peers[0]])
+	assert.Equal(t, Locality{DC: "b"}, locality[peers[1]])
+
+	th.DenyCrossDC = true
+	peers, err = th.GetPeer(1, 1)
+	assert.NoError(t, err)
+	assert.Len(t, peers, 1)
+	assert.Contains(t, peers[0], ":1002")
+
+	resp, err := http.Get("http://localhost:12345/?source=x&batch=1&batch_size=1&dc=a,b")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 500, resp.StatusCode)
+}